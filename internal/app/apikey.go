@@ -0,0 +1,53 @@
+package app
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// apiKeys are the keys that queue a login in the priority lane of the
+// SessionGate (set up in Run from API_KEYS).
+var apiKeys []string
+
+func initAPIKeys() {
+	apiKeys = nil
+	for key := range strings.SplitSeq(os.Getenv("API_KEYS"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			apiKeys = append(apiKeys, key)
+		}
+	}
+	if len(apiKeys) > 0 {
+		log.Printf("API keys enabled: %d key(s) get priority over web requests", len(apiKeys))
+	}
+}
+
+// requestAPIKey returns the key sent as "Authorization: Bearer <key>" or in
+// X-API-Key, if any.
+func requestAPIKey(r *http.Request) string {
+	if key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(key)
+	}
+	return strings.TrimSpace(r.Header.Get("X-API-Key"))
+}
+
+// requestPriority returns the SessionGate lane of r: requests with a valid API
+// key go in the priority lane, those without one in the web lane. A key that
+// is not valid is rejected rather than silently queued as a web request; the
+// error response has then been written.
+func requestPriority(w http.ResponseWriter, r *http.Request) (gatePriority, bool) {
+	key := requestAPIKey(r)
+	if key == "" {
+		return priorityWeb, true
+	}
+	for _, valid := range apiKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(valid)) == 1 {
+			return priorityAPI, true
+		}
+	}
+	log.Printf("Invalid API key from %s", getClientIP(r))
+	sendError(w, codeInvalidAPIKey, "Invalid API key")
+	return priorityWeb, false
+}
@@ -0,0 +1,37 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestPriority(t *testing.T) {
+	orig := apiKeys
+	apiKeys = []string{"automation-key"}
+	t.Cleanup(func() { apiKeys = orig })
+
+	cases := []struct {
+		name         string
+		header, key  string
+		wantPriority gatePriority
+		wantStatus   int
+	}{
+		{"anonymous", "", "", priorityWeb, http.StatusOK},
+		{"bearer", "Authorization", "Bearer automation-key", priorityAPI, http.StatusOK},
+		{"header", "X-API-Key", "automation-key", priorityAPI, http.StatusOK},
+		{"basic auth from a proxy", "Authorization", "Basic dXNlcjpwYXNz", priorityWeb, http.StatusOK},
+		{"wrong key", "X-API-Key", "guess", priorityWeb, http.StatusUnauthorized},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest(http.MethodPost, "/oauth", nil)
+		if tc.header != "" {
+			r.Header.Set(tc.header, tc.key)
+		}
+		w := httptest.NewRecorder()
+		priority, ok := requestPriority(w, r)
+		if priority != tc.wantPriority || ok != (tc.wantStatus == http.StatusOK) || w.Code != tc.wantStatus {
+			t.Errorf("%s: priority %d, ok %v, status %d; want %d, %d", tc.name, priority, ok, w.Code, tc.wantPriority, tc.wantStatus)
+		}
+	}
+}
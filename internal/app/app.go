@@ -7,6 +7,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -25,10 +26,28 @@ func Run() error {
 			"CLOAK_CDP_URL is required: set it to the CloakBrowser CDP endpoint (e.g. http://localhost:9222)",
 		)
 	}
+	registry, err := newExecutorRegistry(
+		strings.Split(getEnv("OAUTH_EXECUTOR", executorChromedp), ","),
+		newChromedpExecutor(), httpExecutor{},
+	)
+	if err != nil {
+		return fmt.Errorf("invalid OAUTH_EXECUTOR: %w", err)
+	}
+	executors = registry
+
+	flows, err := loadLoginFlows(os.Getenv("LOGIN_FLOWS_FILE"))
+	if err != nil {
+		return fmt.Errorf("load login flows: %w", err)
+	}
+	loginFlows = flows
 	sessionGate = newSessionGate(
 		getIntEnv("CLOAK_MAX_SESSIONS", 1),
 		getDurationEnv("CLOAK_QUEUE_TIMEOUT", 60*time.Second),
 	)
+	sessionGate.fair = os.Getenv("CLOAK_QUEUE_FAIR") == "true"
+	sessionGate.maxQueue = max(getIntEnv("CLOAK_QUEUE_MAX", 0), 0)
+	sessionGate.maxBurst = max(getIntEnv("CLOAK_PRIORITY_BURST", defaultPriorityBurst), 0)
+	initAPIKeys()
 
 	if db, err := loadCountryDB(os.Getenv("GEOIP_COUNTRY_DB")); err != nil {
 		log.Printf("GeoIP country pre-selection disabled: %v", err)
@@ -39,6 +58,15 @@ func Run() error {
 
 	initRateLimiter()
 
+	idTokenKeys = newJWKSCache(tokenClient, getDurationEnv("JWKS_CACHE_TTL", time.Hour))
+	initHomeAssistant()
+	initWebhooks()
+	codeLifetime = getDurationEnv("OAUTH_CODE_LIFETIME", 2*time.Minute)
+	sessionRetries = max(getIntEnv("OAUTH_SESSION_RETRIES", 2), 0)
+	failures = newFailureStore(getIntEnv("FAILURE_CAPTURES", defaultFailureCaptures))
+	jobs = newJobStore(getDurationEnv("JOB_RESULT_TTL", defaultJobTTL))
+	jobTimeout = getDurationEnv("JOB_TIMEOUT", jobTimeout)
+
 	if err := applicationMetrics.initialize(configsJSON); err != nil {
 		return fmt.Errorf("initialize metrics: %w", err)
 	}
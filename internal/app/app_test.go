@@ -7,6 +7,16 @@ import (
 	"testing"
 )
 
+// setGlobal points a package-level global (a store, broker or registry the
+// handlers use) at value for the rest of the test, and returns value.
+func setGlobal[T any](t *testing.T, global *T, value T) T {
+	t.Helper()
+	orig := *global
+	*global = value
+	t.Cleanup(func() { *global = orig })
+	return value
+}
+
 func TestRunRequiresCDPURL(t *testing.T) {
 	t.Setenv("CLOAK_CDP_URL", "")
 
@@ -0,0 +1,177 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/chromedp/chromedp"
+)
+
+// consentLabels are the "Allow"/"Continue" captions of the ForgeRock consent
+// button, keyed by language or, where it differs by region, by full locale.
+var consentLabels = map[string][]string{
+	"en":    {"Allow", "Continue", "Accept", "Authorize", "Authorise", "I agree"},
+	"de":    {"Erlauben", "Zulassen", "Weiter", "Akzeptieren", "Zustimmen", "Autorisieren"},
+	"fr":    {"Autoriser", "Continuer", "Accepter", "Valider"},
+	"it":    {"Consenti", "Autorizza", "Continua", "Accetta"},
+	"es":    {"Permitir", "Continuar", "Aceptar", "Autorizar"},
+	"pt":    {"Permitir", "Continuar", "Aceitar", "Autorizar"},
+	"pt-BR": {"Permitir", "Continuar", "Aceitar", "Autorizar", "Concordo"},
+	"nl":    {"Toestaan", "Doorgaan", "Accepteren", "Akkoord"},
+	"pl":    {"Zezwól", "Zezwalaj", "Kontynuuj", "Akceptuj", "Zgadzam się"},
+	"cs":    {"Povolit", "Pokračovat", "Přijmout", "Souhlasím"},
+	"sk":    {"Povoliť", "Pokračovať", "Prijať", "Súhlasím"},
+	"hu":    {"Engedélyezés", "Engedélyez", "Folytatás", "Elfogadás"},
+	"ro":    {"Permite", "Permiteți", "Continuă", "Accept"},
+	"hr":    {"Dopusti", "Nastavi", "Prihvati"},
+	"sr":    {"Dozvoli", "Nastavi", "Prihvati"},
+	"sl":    {"Dovoli", "Nadaljuj", "Sprejmi"},
+	"bg":    {"Разреши", "Продължи", "Приеми"},
+	"el":    {"Να επιτρέπεται", "Επιτρέπεται", "Συνέχεια", "Αποδοχή"},
+	"ru":    {"Разрешить", "Продолжить", "Принять"},
+	"uk":    {"Дозволити", "Продовжити", "Прийняти"},
+	"tr":    {"İzin ver", "Devam", "Kabul et"},
+	"sv":    {"Tillåt", "Fortsätt", "Godkänn"},
+	"da":    {"Tillad", "Fortsæt", "Accepter"},
+	"nb":    {"Tillat", "Fortsett", "Godta"},
+	"fi":    {"Salli", "Jatka", "Hyväksy"},
+	"et":    {"Luba", "Jätka", "Nõustun"},
+	"lv":    {"Atļaut", "Turpināt", "Piekrītu"},
+	"lt":    {"Leisti", "Tęsti", "Sutinku"},
+	"ja":    {"許可", "許可する", "続行", "同意する"},
+	"ko":    {"허용", "계속", "동의"},
+	"zh":    {"允許", "允许", "繼續", "同意"},
+	"fa":    {"اجازه", "ادامه", "موافقم"},
+}
+
+// labelsForLocale returns the consent labels for locale ("it-IT"), falling
+// back from the full locale to its language and then to English.
+func labelsForLocale(locale string) []string {
+	if labels, ok := consentLabels[locale]; ok {
+		return labels
+	}
+	lang, _, _ := strings.Cut(locale, "-")
+	if labels, ok := consentLabels[strings.ToLower(lang)]; ok {
+		return labels
+	}
+	return consentLabels["en"]
+}
+
+// allConsentLabels returns every known label, for the text-content fallback.
+func allConsentLabels() []string {
+	var all []string
+	for _, labels := range consentLabels {
+		for _, label := range labels {
+			if !slices.Contains(all, label) {
+				all = append(all, label)
+			}
+		}
+	}
+	slices.Sort(all)
+	return all
+}
+
+// consentNegations are words that turn a consent caption into a refusal
+// ("Nicht zulassen", "Non consentire", "Don't allow"). Languages that negate
+// with a prefix ("Nepovolit") never match a label on word boundaries anyway.
+var consentNegations = []string{
+	"not", "don't", "dont", "no", "deny", "decline", "refuse", "reject",
+	"nicht", "kein", "ablehnen", "verweigern", "ne", "pas", "refuser",
+	"non", "rifiuta", "nega", "não", "rechazar", "recusar", "denegar",
+	"niet", "weigeren", "nie", "odrzuć", "odmów", "nem", "elutasítás",
+	"nu", "refuză", "odbij", "zavrni", "не", "отказ", "отклонить",
+	"відхилити", "μην", "δεν", "απόρριψη", "reddet", "inte", "neka", "avvisa",
+	"ikke", "afvis", "avslå", "älä", "hylkää", "ära", "keeldu", "noraidīt",
+	"atmesti", "رد",
+}
+
+// consentButton is a visible button on the page, as clickByLabel sees it.
+type consentButton struct {
+	Caption string `json:"caption"`
+	InForm  bool   `json:"inForm"`
+}
+
+// clickByLabel looks for a visible button whose caption matches a consent
+// label and clicks it (see pickConsentButton). It returns which strategy
+// matched, or "" when nothing did.
+func clickByLabel(browserCtx context.Context, locale string) (string, error) {
+	var buttons []consentButton
+	err := chromedp.Run(browserCtx, chromedp.Evaluate(`
+		(function() {
+			Array.prototype.forEach.call(document.querySelectorAll('[data-consent-index]'),
+				function(el) { el.removeAttribute('data-consent-index'); });
+			var buttons = Array.prototype.filter.call(
+				document.querySelectorAll('input[type="submit"], input[type="button"], button'),
+				function(el) { return el.offsetParent !== null && !el.disabled; });
+			return buttons.map(function(el, i) {
+				el.setAttribute('data-consent-index', i);
+				return {caption: el.tagName === 'INPUT' ? el.value : el.textContent, inForm: !!el.form};
+			});
+		})()
+	`, &buttons))
+	if err != nil {
+		return "", err
+	}
+	i, matched := pickConsentButton(buttons, labelsForLocale(locale), allConsentLabels())
+	if i < 0 {
+		return "", nil
+	}
+	return matched, jsClick(browserCtx, fmt.Sprintf(`[data-consent-index="%d"]`, i))
+}
+
+// pickConsentButton returns the index of the consent button among buttons
+// and which strategy found it, or -1. Only buttons inside a form count, so a
+// cookie banner's "Accept" is never taken for consent. It tries the locale's
+// labels as exact captions first, then any known label as whole words of the
+// caption (pages whose language does not match the country's locale).
+// Captions with a negation are refusals and never match there.
+func pickConsentButton(buttons []consentButton, localeLabels, allLabels []string) (int, string) {
+	for i, b := range buttons {
+		if !b.InForm {
+			continue
+		}
+		caption := normalizeCaption(b.Caption)
+		for _, label := range localeLabels {
+			if caption == normalizeCaption(label) {
+				return i, fmt.Sprintf("locale label %q", caption)
+			}
+		}
+	}
+	for i, b := range buttons {
+		words := captionWords(b.Caption)
+		if !b.InForm || slices.ContainsFunc(words, func(w string) bool { return slices.Contains(consentNegations, w) }) {
+			continue
+		}
+		for _, label := range allLabels {
+			if containsWords(words, captionWords(label)) {
+				return i, fmt.Sprintf("text content %q", normalizeCaption(b.Caption))
+			}
+		}
+	}
+	return -1, ""
+}
+
+func normalizeCaption(s string) string {
+	return strings.ToLower(strings.Join(strings.Fields(s), " "))
+}
+
+// captionWords splits a caption into lowercase words, keeping apostrophes
+// ("don't") and combining marks.
+func captionWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsMark(r) && !unicode.IsNumber(r) && r != '\'' && r != '’'
+	})
+}
+
+// containsWords reports whether phrase occurs in words as a run of whole words.
+func containsWords(words, phrase []string) bool {
+	for i := 0; len(phrase) > 0 && i+len(phrase) <= len(words); i++ {
+		if slices.Equal(words[i:i+len(phrase)], phrase) {
+			return true
+		}
+	}
+	return false
+}
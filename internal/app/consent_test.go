@@ -0,0 +1,77 @@
+package app
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLabelsForLocale(t *testing.T) {
+	cases := map[string]string{
+		"it-IT": "Consenti",
+		"es-MX": "Permitir",
+		"pt-BR": "Concordo",
+		"nl-NL": "Toestaan",
+		"xx-YY": "Allow",
+		"":      "Allow",
+	}
+	for locale, want := range cases {
+		if labels := labelsForLocale(locale); !slices.Contains(labels, want) {
+			t.Errorf("labelsForLocale(%q) = %v, want %q among them", locale, labels, want)
+		}
+	}
+}
+
+// Every language we have a client for should get its own labels rather than
+// the English fallback.
+func TestConsentLabelsCoverConfiguredLocales(t *testing.T) {
+	var configs map[string]BrandConfig
+	if err := json.Unmarshal(configsJSON, &configs); err != nil {
+		t.Fatal(err)
+	}
+	for brand, bc := range configs {
+		for country, cc := range bc.Configs {
+			lang, _, _ := strings.Cut(cc.Locale, "-")
+			if _, ok := consentLabels[lang]; !ok {
+				t.Errorf("%s/%s: no consent labels for locale %q", brand, country, cc.Locale)
+			}
+		}
+	}
+}
+
+func TestAllConsentLabelsAreUnique(t *testing.T) {
+	all := allConsentLabels()
+	if len(all) == 0 || len(slices.Compact(slices.Clone(all))) != len(all) {
+		t.Errorf("allConsentLabels() = %v, want a non-empty list without duplicates", all)
+	}
+}
+
+func TestPickConsentButton(t *testing.T) {
+	labels, all := labelsForLocale("de-DE"), allConsentLabels()
+	cases := []struct {
+		name    string
+		buttons []consentButton
+		want    int
+	}{
+		{"locale label", []consentButton{{Caption: "Abbrechen", InForm: true}, {Caption: " Zulassen\n", InForm: true}}, 1},
+		{"locale label outside a form", []consentButton{{Caption: "Erlauben"}}, -1},
+		{"cookie banner before the form", []consentButton{
+			{Caption: "Akzeptieren"}, {Caption: "Erlauben", InForm: true},
+		}, 1},
+		{"deny button before allow", []consentButton{
+			{Caption: "Nicht zulassen", InForm: true}, {Caption: "Allow access", InForm: true},
+		}, 1},
+		{"italian deny button", []consentButton{
+			{Caption: "Non consentire", InForm: true}, {Caption: "Consenti", InForm: true},
+		}, 1},
+		{"english deny only", []consentButton{{Caption: "Don't allow", InForm: true}}, -1},
+		{"label inside another word", []consentButton{{Caption: "Unzulassen", InForm: true}}, -1},
+		{"other language outside a form", []consentButton{{Caption: "Allow"}}, -1},
+	}
+	for _, tc := range cases {
+		if got, _ := pickConsentButton(tc.buttons, labels, all); got != tc.want {
+			t.Errorf("%s: pickConsentButton() = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// errorCode is the machine-readable class of a failed request, returned as
+// error_code in JSON responses, SSE error events and webhooks so clients can
+// tell failures worth retrying from ones to show the user.
+type errorCode string
+
+const (
+	codeInvalidCredentials   errorCode = "invalid_credentials"
+	codeAccountLocked        errorCode = "account_locked"
+	codeCaptchaBlocked       errorCode = "captcha_blocked"
+	codeVerificationRequired errorCode = "verification_required"
+	codeAuthFailed           errorCode = "auth_failed" // the login did not complete for another reason
+	codeBackendUnavailable   errorCode = "backend_unavailable"
+	codeBusy                 errorCode = "busy"
+	codeQueueFull            errorCode = "queue_full"
+	codeSessionExpired       errorCode = "session_expired"
+	codeStellantisError      errorCode = "stellantis_error"
+	codeTimeout              errorCode = "timeout"
+	codeClientAborted        errorCode = "client_aborted" // the caller disconnected mid-login
+	codeUnknownBrand         errorCode = "unknown_brand"
+	codeTokenExchange        errorCode = "token_exchange_failed"
+	codeInvalidRequest       errorCode = "invalid_request"
+	codeMethodNotAllowed     errorCode = "method_not_allowed"
+	codeNotFound             errorCode = "not_found"
+	codeRateLimited          errorCode = "rate_limited"
+	codeInvalidAPIKey        errorCode = "invalid_api_key"
+	codeInternal             errorCode = "internal_error"
+)
+
+// errorStatus is the HTTP status each error code is sent with.
+var errorStatus = map[errorCode]int{
+	codeInvalidCredentials:   http.StatusUnauthorized,
+	codeAccountLocked:        http.StatusLocked,
+	codeCaptchaBlocked:       http.StatusForbidden,
+	codeVerificationRequired: http.StatusUnauthorized,
+	codeAuthFailed:           http.StatusBadGateway,
+	codeBackendUnavailable:   http.StatusServiceUnavailable,
+	codeBusy:                 http.StatusServiceUnavailable,
+	codeQueueFull:            http.StatusServiceUnavailable,
+	codeSessionExpired:       http.StatusServiceUnavailable,
+	codeStellantisError:      http.StatusBadGateway,
+	codeTimeout:              http.StatusGatewayTimeout,
+	codeClientAborted:        statusClientClosedRequest,
+	codeUnknownBrand:         http.StatusBadRequest,
+	codeTokenExchange:        http.StatusBadRequest,
+	codeInvalidRequest:       http.StatusBadRequest,
+	codeMethodNotAllowed:     http.StatusMethodNotAllowed,
+	codeNotFound:             http.StatusNotFound,
+	codeRateLimited:          http.StatusTooManyRequests,
+	codeInvalidAPIKey:        http.StatusUnauthorized,
+	codeInternal:             http.StatusInternalServerError,
+}
+
+// statusClientClosedRequest is nginx's non-standard status for a client that
+// went away; there is nobody left to receive it, but logs and webhooks see it.
+const statusClientClosedRequest = 499
+
+// status returns the HTTP status for c.
+func (c errorCode) status() int {
+	if status, ok := errorStatus[c]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// errorCodeOf classifies an error from the login or token flows. The more
+// specific sentinels wrap the general ones, so they are checked first.
+func errorCodeOf(err error) errorCode {
+	switch {
+	case errors.Is(err, errClientAborted):
+		return codeClientAborted
+	case errors.Is(err, errServiceBusy), errors.Is(err, ErrSessionBusy):
+		return codeBusy
+	case errors.Is(err, ErrQueueFull):
+		return codeQueueFull
+	case errors.Is(err, errBackendUnavailable):
+		return codeBackendUnavailable
+	case errors.Is(err, errSessionExpired):
+		return codeSessionExpired
+	case errors.Is(err, errUnknownBrand), errors.Is(err, errUnknownCountry):
+		return codeUnknownBrand
+	case errors.Is(err, errAccountLocked):
+		return codeAccountLocked
+	case errors.Is(err, errCaptchaBlocked):
+		return codeCaptchaBlocked
+	case errors.Is(err, errCredentialsRejected):
+		return codeInvalidCredentials
+	case errors.Is(err, errNoInteractiveInput):
+		return codeVerificationRequired
+	case errors.Is(err, errStellantis):
+		return codeStellantisError
+	case errors.Is(err, errNoRedirect), errors.Is(err, context.DeadlineExceeded):
+		return codeTimeout
+	case errors.Is(err, errAuthFailed):
+		return codeAuthFailed
+	case errors.Is(err, errTokenExchange):
+		return codeTokenExchange
+	}
+	return codeInternal
+}
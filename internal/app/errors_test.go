@@ -0,0 +1,65 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestErrorCodeOf(t *testing.T) {
+	cases := map[error]errorCode{
+		errServiceBusy: codeBusy,
+		ErrQueueFull:   codeQueueFull,
+		fmt.Errorf("%w: dial tcp: refused", errBackendUnavailable): codeBackendUnavailable,
+		errSessionExpired:                                           codeSessionExpired,
+		fmt.Errorf("%w: Nope", errUnknownBrand):                     codeUnknownBrand,
+		fmt.Errorf("%w for brand MyPeugeot: XX", errUnknownCountry): codeUnknownBrand,
+		gigyaError(403042, "invalid loginID or password"):           codeInvalidCredentials,
+		gigyaError(403120, "account temporarily locked out"):        codeAccountLocked,
+		gigyaError(401020, "captcha required"):                      codeCaptchaBlocked,
+		errNoInteractiveInput:                                       codeVerificationRequired,
+		fmt.Errorf("%w: invalid request", errStellantis):            codeStellantisError,
+		errNoRedirect: codeTimeout,
+		fmt.Errorf("%w: %w", errClientAborted, context.Canceled):                   codeClientAborted,
+		fmt.Errorf("login form not found (timeout): %w", context.DeadlineExceeded): codeTimeout,
+		fmt.Errorf("%w: Gigya SDK not found", errAuthFailed):                       codeAuthFailed,
+		fmt.Errorf("%w: invalid_grant", errTokenExchange):                          codeTokenExchange,
+		errors.New("something else"):                                               codeInternal,
+	}
+	for err, want := range cases {
+		if got := errorCodeOf(err); got != want {
+			t.Errorf("errorCodeOf(%q) = %q, want %q", err, got, want)
+		}
+	}
+}
+
+func TestSendErrorUsesCodeStatus(t *testing.T) {
+	w := httptest.NewRecorder()
+	sendError(w, codeAccountLocked, "account temporarily locked out")
+
+	if w.Code != http.StatusLocked {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusLocked)
+	}
+	var resp OAuthResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != "error" || resp.ErrorCode != codeAccountLocked {
+		t.Errorf("response = %+v", resp)
+	}
+}
+
+func TestEveryErrorCodeHasAStatus(t *testing.T) {
+	for code, status := range errorStatus {
+		if status < 400 || code.status() != status {
+			t.Errorf("%s: status %d", code, status)
+		}
+	}
+	if errorCode("made_up").status() != http.StatusInternalServerError {
+		t.Error("unknown codes should be internal errors")
+	}
+}
@@ -0,0 +1,247 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Executor names accepted in configs.json ("executor") and OAUTH_EXECUTOR.
+const (
+	executorChromedp = "chromedp"
+	executorHTTP     = "http"
+)
+
+// oauthExecutor performs the interactive part of a login, from the
+// authorization URL to the captured code.
+type oauthExecutor interface {
+	Name() string
+	Run(ctx context.Context, attempt oauthAttempt, progress ProgressFunc, debug DebugFunc) (authCode, error)
+	// Healthy reports whether the executor can take a login right now.
+	Healthy() bool
+	// Supports reports whether the executor can log in to a brand/country.
+	Supports(brand BrandConfig, country CountryConfig) bool
+}
+
+// executors is the registry performOAuth consults (set up in Run).
+var executors *executorRegistry
+
+// executorRegistry holds the known executors and the fallback order used for
+// brands/countries that do not prefer one.
+type executorRegistry struct {
+	byName map[string]oauthExecutor
+	order  []oauthExecutor
+}
+
+// newExecutorRegistry registers all and orders them by the names in order
+// (e.g. OAUTH_EXECUTOR=http,chromedp). Executors missing from order are only
+// used where configs.json asks for them.
+func newExecutorRegistry(order []string, all ...oauthExecutor) (*executorRegistry, error) {
+	r := &executorRegistry{byName: make(map[string]oauthExecutor)}
+	for _, ex := range all {
+		r.byName[ex.Name()] = ex
+	}
+	for _, name := range order {
+		name = strings.TrimSpace(name)
+		ex, ok := r.byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown executor %q", name)
+		}
+		r.order = append(r.order, ex)
+	}
+	if len(r.order) == 0 {
+		return nil, errors.New("no executor configured")
+	}
+	return r, nil
+}
+
+// candidates returns the executors to try for a brand/country, in order: the
+// country's "executor" from configs.json, else the brand's, then the registry
+// order. Executors that do not support the brand are skipped, as are
+// unhealthy ones unless none is healthy: a backend that only looked down is
+// still worth a try when there is nothing else.
+func (r *executorRegistry) candidates(brand BrandConfig, country CountryConfig) []oauthExecutor {
+	ordered := make([]oauthExecutor, 0, len(r.order)+1)
+	preferred := country.Executor
+	if preferred == "" {
+		preferred = brand.Executor
+	}
+	if ex, ok := r.byName[preferred]; ok {
+		ordered = append(ordered, ex)
+	} else if preferred != "" {
+		log.Printf("Ignoring unknown executor %q in configs", preferred)
+	}
+	ordered = append(ordered, r.order...)
+
+	var supported, healthy []oauthExecutor
+	seen := make(map[string]bool)
+	for _, ex := range ordered {
+		if seen[ex.Name()] || !ex.Supports(brand, country) {
+			continue
+		}
+		seen[ex.Name()] = true
+		supported = append(supported, ex)
+		if ex.Healthy() {
+			healthy = append(healthy, ex)
+		}
+	}
+	if len(healthy) == 0 {
+		return supported
+	}
+	return healthy
+}
+
+// run logs in with the first candidate executor, falling back to the next one
+// on failure. Rejected credentials end the attempt: trying them again
+// elsewhere would only risk locking the account. So does an expired session,
+// which performOAuthWithExecutor retries with the same authorization URL in a
+// new browser session. It returns the name of the executor that produced the result (or failed last).
+func (r *executorRegistry) run(
+	ctx context.Context,
+	req OAuthRequest,
+	attempt oauthAttempt,
+	brand BrandConfig,
+	country CountryConfig,
+	progress ProgressFunc,
+	debug DebugFunc,
+	metrics *oauthMetrics,
+) (authCode, string, error) {
+	candidates := r.candidates(brand, country)
+	if len(candidates) == 0 {
+		return authCode{}, "", fmt.Errorf("%w: no executor supports %s/%s", errBackendUnavailable, req.Brand, req.Country)
+	}
+
+	var err error
+	var name string
+	for i, ex := range candidates {
+		name = ex.Name()
+		if i > 0 && progress != nil {
+			progress(fmt.Sprintf("Retrying with the %s executor...", name))
+		}
+		log.Printf("[%s] Logging in with the %s executor", attempt.requestID, name)
+
+		var code authCode
+		code, err = ex.Run(ctx, attempt, progress, debug)
+		metrics.recordExecutor(name, req.Brand, req.Country, err)
+		if err == nil {
+			return code, name, nil
+		}
+		log.Printf("[%s] %s executor failed: %v", attempt.requestID, name, err)
+		// Nobody is waiting for a fallback once the client has gone.
+		if errors.Is(err, errCredentialsRejected) || errors.Is(err, errSessionExpired) || ctx.Err() != nil {
+			break
+		}
+	}
+	return authCode{}, name, err
+}
+
+// cdpHealthRecheck is how often an unreachable CloakBrowser is probed again.
+const cdpHealthRecheck = 30 * time.Second
+
+// chromedpExecutor logs in by driving a CloakBrowser session.
+type chromedpExecutor struct {
+	health *backendHealth
+}
+
+func newChromedpExecutor() chromedpExecutor {
+	return chromedpExecutor{health: newBackendHealth(cdpHealthRecheck, func() bool {
+		_, err := discoverCDPWebSocketURL(os.Getenv("CLOAK_CDP_URL"), "", &http.Client{Timeout: 2 * time.Second})
+		return err == nil
+	})}
+}
+
+func (chromedpExecutor) Name() string { return executorChromedp }
+
+func (e chromedpExecutor) Run(ctx context.Context, attempt oauthAttempt, progress ProgressFunc, debug DebugFunc) (authCode, error) {
+	code, err := performChromedpOAuth(ctx, attempt, progress, debug)
+	if errors.Is(err, errBackendUnavailable) {
+		e.health.failed()
+	} else {
+		e.health.reached()
+	}
+	return code, err
+}
+
+// Healthy reports whether CloakBrowser was reachable (see backendHealth).
+func (e chromedpExecutor) Healthy() bool {
+	return e.health.healthy()
+}
+
+// backendHealth tracks whether a backend is up without probing it on every
+// login: a bare CDP /json/version request reaches CloakBrowser's shared
+// session, which wedges it. The backend counts as up until a login fails to
+// reach it; it is then probed at most once per interval until it answers.
+type backendHealth struct {
+	interval time.Duration
+	probe    func() bool
+
+	mu      sync.Mutex
+	down    bool
+	probing bool
+	checked time.Time
+}
+
+func newBackendHealth(interval time.Duration, probe func() bool) *backendHealth {
+	return &backendHealth{interval: interval, probe: probe}
+}
+
+// failed marks the backend as down after a login could not reach it.
+func (h *backendHealth) failed() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.down {
+		h.down, h.checked = true, time.Now()
+	}
+}
+
+// reached marks the backend as up after a login got through to it.
+func (h *backendHealth) reached() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.down = false
+}
+
+// healthy reports whether the backend is up, probing a down one once its
+// interval has passed. The probe runs without h.mu; callers that arrive
+// meanwhile still see it as down.
+func (h *backendHealth) healthy() bool {
+	h.mu.Lock()
+	if !h.down || h.probing || time.Since(h.checked) < h.interval {
+		defer h.mu.Unlock()
+		return !h.down
+	}
+	h.probing = true
+	h.mu.Unlock()
+
+	up := h.probe()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.probing, h.down, h.checked = false, !up, time.Now()
+	return up
+}
+
+func (chromedpExecutor) Supports(BrandConfig, CountryConfig) bool { return true }
+
+// httpExecutor logs in with plain HTTP requests (see performHTTPOAuth).
+type httpExecutor struct{}
+
+func (httpExecutor) Name() string { return executorHTTP }
+
+func (httpExecutor) Run(ctx context.Context, attempt oauthAttempt, progress ProgressFunc, debug DebugFunc) (authCode, error) {
+	return performHTTPOAuth(ctx, attempt, progress, debug)
+}
+
+func (httpExecutor) Healthy() bool { return true }
+
+// Supports excludes logins that configs.json marks as reCAPTCHA-protected,
+// which only a real browser gets through.
+func (httpExecutor) Supports(brand BrandConfig, country CountryConfig) bool {
+	return !brand.Recaptcha && !country.Recaptcha
+}
@@ -0,0 +1,249 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubExecutor is an oauthExecutor whose behaviour is set by the test.
+type stubExecutor struct {
+	name        string
+	run         func(oauthAttempt, ProgressFunc, DebugFunc) (authCode, error)
+	unhealthy   bool
+	unsupported bool
+	calls       int
+}
+
+func (s *stubExecutor) Name() string { return s.name }
+
+func (s *stubExecutor) Run(_ context.Context, attempt oauthAttempt, progress ProgressFunc, debug DebugFunc) (authCode, error) {
+	s.calls++
+	return s.run(attempt, progress, debug)
+}
+
+func (s *stubExecutor) Healthy() bool { return !s.unhealthy }
+
+func (s *stubExecutor) Supports(BrandConfig, CountryConfig) bool { return !s.unsupported }
+
+// stubExecutors returns a registry with a single executor running run.
+func stubExecutors(run func(oauthAttempt, ProgressFunc, DebugFunc) (authCode, error)) *executorRegistry {
+	r, _ := newExecutorRegistry([]string{"stub"}, &stubExecutor{name: "stub", run: run})
+	return r
+}
+
+func succeedWith(code string) func(oauthAttempt, ProgressFunc, DebugFunc) (authCode, error) {
+	return func(oauthAttempt, ProgressFunc, DebugFunc) (authCode, error) {
+		return authCode{value: code, issuedAt: time.Now()}, nil
+	}
+}
+
+func failWith(err error) func(oauthAttempt, ProgressFunc, DebugFunc) (authCode, error) {
+	return func(oauthAttempt, ProgressFunc, DebugFunc) (authCode, error) { return authCode{}, err }
+}
+
+func TestNewExecutorRegistryRejectsUnknownName(t *testing.T) {
+	if _, err := newExecutorRegistry([]string{"http", "selenium"}, httpExecutor{}); err == nil {
+		t.Fatal("newExecutorRegistry() error = nil, want unknown executor")
+	}
+	if _, err := newExecutorRegistry(nil, httpExecutor{}); err == nil {
+		t.Fatal("newExecutorRegistry() error = nil, want no executor configured")
+	}
+}
+
+func TestExecutorRegistryCandidates(t *testing.T) {
+	first := &stubExecutor{name: "first"}
+	second := &stubExecutor{name: "second"}
+	extra := &stubExecutor{name: "extra"}
+	r, err := newExecutorRegistry([]string{"first", " second"}, first, second, extra)
+	if err != nil {
+		t.Fatalf("newExecutorRegistry() error = %v", err)
+	}
+	names := func(brand BrandConfig, country CountryConfig) string {
+		var out []string
+		for _, ex := range r.candidates(brand, country) {
+			out = append(out, ex.Name())
+		}
+		return strings.Join(out, ",")
+	}
+
+	if got := names(BrandConfig{}, CountryConfig{}); got != "first,second" {
+		t.Errorf("default order = %q", got)
+	}
+	if got := names(BrandConfig{Executor: "second"}, CountryConfig{}); got != "second,first" {
+		t.Errorf("brand preference = %q", got)
+	}
+	if got := names(BrandConfig{Executor: "second"}, CountryConfig{Executor: "extra"}); got != "extra,first,second" {
+		t.Errorf("country preference = %q", got)
+	}
+
+	first.unhealthy = true
+	if got := names(BrandConfig{}, CountryConfig{}); got != "second" {
+		t.Errorf("unhealthy executor not skipped: %q", got)
+	}
+	second.unsupported = true
+	if got := names(BrandConfig{}, CountryConfig{}); got != "first" {
+		t.Errorf("the last supported executor should be tried even if unhealthy: %q", got)
+	}
+}
+
+func TestHTTPExecutorSkipsRecaptcha(t *testing.T) {
+	if (httpExecutor{}).Supports(BrandConfig{}, CountryConfig{Recaptcha: true}) {
+		t.Error("http executor should not support reCAPTCHA-protected logins")
+	}
+	if !(httpExecutor{}).Supports(BrandConfig{}, CountryConfig{}) {
+		t.Error("http executor should support plain logins")
+	}
+}
+
+func TestPerformOAuthWithExecutorFallsBack(t *testing.T) {
+	metrics := newOAuthMetrics()
+	if err := metrics.initialize([]byte(testMetricsConfigs)); err != nil {
+		t.Fatalf("initialize() error = %v", err)
+	}
+	broken := &stubExecutor{name: "http", run: failWith(fmt.Errorf("%w: Gigya SDK not found", errAuthFailed))}
+	browser := &stubExecutor{name: "chromedp", run: succeedWith("oauth-code")}
+	r, _ := newExecutorRegistry([]string{"http", "chromedp"}, broken, browser)
+
+	var steps []string
+	req := OAuthRequest{Brand: "MyPeugeot", Country: "DE", Email: "driver@example.com", Password: "secret"}
+	data, err := performOAuthWithExecutor(context.Background(), req, "request-id", func(s string) { steps = append(steps, s) }, nil, metrics, r)
+	if err != nil {
+		t.Fatalf("performOAuthWithExecutor() error = %v", err)
+	}
+	if data.Code != "oauth-code" || data.Executor != "chromedp" {
+		t.Errorf("data = %+v, want code from chromedp", data)
+	}
+	if !strings.Contains(strings.Join(steps, "\n"), "Retrying with the chromedp executor") {
+		t.Errorf("fallback not reported in progress: %q", steps)
+	}
+
+	body := scrapeMetrics(t, metrics.handler())
+	for _, want := range []string{
+		`stelloauth_executor_attempts_total{brand="MyPeugeot",country="DE",executor="http",outcome="failure"} 1`,
+		`stelloauth_executor_attempts_total{brand="MyPeugeot",country="DE",executor="chromedp",outcome="success"} 1`,
+		`stelloauth_oauth_success_total{brand="MyPeugeot",country="DE"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics body missing %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestPerformOAuthWithExecutorStopsWhenClientAborts(t *testing.T) {
+	metrics := newOAuthMetrics()
+	if err := metrics.initialize([]byte(testMetricsConfigs)); err != nil {
+		t.Fatalf("initialize() error = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	aborted := &stubExecutor{name: "http", run: func(oauthAttempt, ProgressFunc, DebugFunc) (authCode, error) {
+		cancel()
+		return authCode{}, errors.New("websocket closed")
+	}}
+	browser := &stubExecutor{name: "chromedp", run: succeedWith("oauth-code")}
+	r, _ := newExecutorRegistry([]string{"http", "chromedp"}, aborted, browser)
+
+	req := OAuthRequest{Brand: "MyPeugeot", Country: "DE", Email: "driver@example.com", Password: "secret"}
+	_, err := performOAuthWithExecutor(ctx, req, "request-id", nil, nil, metrics, r)
+	if !errors.Is(err, errClientAborted) || errorCodeOf(err) != codeClientAborted {
+		t.Fatalf("performOAuthWithExecutor() error = %v, want client aborted", err)
+	}
+	if browser.calls != 0 {
+		t.Error("an aborted login fell back to another executor")
+	}
+
+	body := scrapeMetrics(t, metrics.handler())
+	for _, want := range []string{
+		`stelloauth_executor_attempts_total{brand="MyPeugeot",country="DE",executor="http",outcome="failure"} 1`,
+		`stelloauth_oauth_aborted_total{brand="MyPeugeot",country="DE"} 1`,
+		`stelloauth_oauth_failure_total{brand="MyPeugeot",country="DE"} 0`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics body missing %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestPerformOAuthWithExecutorDoesNotRetryRejectedCredentials(t *testing.T) {
+	rejecting := &stubExecutor{name: "http", run: failWith(fmt.Errorf("%w: invalid password", errCredentialsRejected))}
+	browser := &stubExecutor{name: "chromedp", run: succeedWith("oauth-code")}
+	r, _ := newExecutorRegistry([]string{"http", "chromedp"}, rejecting, browser)
+
+	req := OAuthRequest{Brand: "MyPeugeot", Country: "DE", Email: "driver@example.com", Password: "wrong"}
+	_, err := performOAuthWithExecutor(context.Background(), req, "request-id", nil, nil, newOAuthMetrics(), r)
+	if !errors.Is(err, errAuthFailed) {
+		t.Fatalf("performOAuthWithExecutor() error = %v, want authentication failure", err)
+	}
+	if err.Error() != "authentication failed: invalid password" {
+		t.Errorf("error = %q", err)
+	}
+	if browser.calls != 0 {
+		t.Error("rejected credentials were retried with another executor")
+	}
+}
+
+func TestPerformOAuthWithExecutorLeavesExpiredSessionsToTheRetry(t *testing.T) {
+	orig := sessionRetries
+	sessionRetries = 0
+	t.Cleanup(func() { sessionRetries = orig })
+	expiring := &stubExecutor{name: "chromedp", run: failWith(errSessionExpired)}
+	fallback := &stubExecutor{name: "http", run: succeedWith("oauth-code")}
+	r, _ := newExecutorRegistry([]string{"chromedp", "http"}, expiring, fallback)
+
+	req := OAuthRequest{Brand: "MyPeugeot", Country: "DE", Email: "driver@example.com", Password: "secret"}
+	_, err := performOAuthWithExecutor(context.Background(), req, "request-id", nil, nil, newOAuthMetrics(), r)
+	if !errors.Is(err, errSessionExpired) {
+		t.Fatalf("performOAuthWithExecutor() error = %v, want session expired", err)
+	}
+	if fallback.calls != 0 {
+		t.Error("an expired session fell back to another executor")
+	}
+}
+
+func TestBackendHealthProbesOnlyAfterFailure(t *testing.T) {
+	probes, up := 0, false
+	h := newBackendHealth(time.Hour, func() bool { probes++; return up })
+
+	if !h.healthy() || probes != 0 {
+		t.Fatalf("healthy() = false or probed (%d) before any failure", probes)
+	}
+	h.failed()
+	if h.healthy() || probes != 0 {
+		t.Fatalf("healthy() right after a failure: probes = %d, want 0 and down", probes)
+	}
+
+	h.checked = time.Now().Add(-2 * time.Hour)
+	up = true
+	if !h.healthy() || probes != 1 {
+		t.Fatalf("healthy() after the interval: probes = %d, want 1 and up", probes)
+	}
+	if !h.healthy() || probes != 1 {
+		t.Errorf("healthy() once recovered probed again: %d", probes)
+	}
+
+	h.failed()
+	h.reached()
+	if !h.healthy() || probes != 1 {
+		t.Errorf("healthy() after a login got through: probes = %d, want 1 and up", probes)
+	}
+}
+
+func TestPerformOAuthWithExecutorTriesTheOnlyExecutorWhenUnhealthy(t *testing.T) {
+	browser := &stubExecutor{name: "chromedp", run: succeedWith("oauth-code"), unhealthy: true}
+	r, _ := newExecutorRegistry([]string{"chromedp"}, browser)
+
+	req := OAuthRequest{Brand: "MyPeugeot", Country: "DE", Email: "driver@example.com", Password: "secret"}
+	data, err := performOAuthWithExecutor(context.Background(), req, "request-id", nil, nil, newOAuthMetrics(), r)
+	if err != nil || data.Code != "oauth-code" {
+		t.Fatalf("performOAuthWithExecutor() = %+v, %v; want the code", data, err)
+	}
+
+	browser.unsupported = true
+	if _, err := performOAuthWithExecutor(context.Background(), req, "request-id", nil, nil, newOAuthMetrics(), r); !errors.Is(err, errBackendUnavailable) {
+		t.Fatalf("performOAuthWithExecutor() error = %v, want backend unavailable", err)
+	}
+}
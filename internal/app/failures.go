@@ -0,0 +1,154 @@
+package app
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/chromedp/chromedp"
+)
+
+// defaultFailureCaptures is how many failed logins keep their diagnostics.
+const defaultFailureCaptures = 20
+
+// failures holds diagnostics of the most recent failed browser logins, for
+// the operator endpoints on the metrics listener (set up in Run).
+var failures = newFailureStore(defaultFailureCaptures)
+
+// failureStore keeps what was captured for failed logins in memory, keyed by
+// request ID. Once it holds max requests the oldest is dropped; max 0 turns
+// capturing off.
+type failureStore struct {
+	mu      sync.Mutex
+	max     int
+	order   []string
+	entries map[string]*failureCapture
+}
+
+type failureCapture struct {
+	capturedAt time.Time
+	screenshot []byte // PNG, credential fields masked
+	har        []byte // HAR 1.2 network trace, secrets redacted
+}
+
+func newFailureStore(maxRequests int) *failureStore {
+	return &failureStore{max: maxRequests, entries: make(map[string]*failureCapture)}
+}
+
+func (s *failureStore) enabled() bool {
+	return s.max > 0
+}
+
+// putScreenshot records png as the failure screenshot of requestID.
+func (s *failureStore) putScreenshot(requestID string, png []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entry(requestID).screenshot = png
+}
+
+// entry returns the capture of requestID, creating it (and evicting the
+// oldest) as needed. The caller holds s.mu.
+func (s *failureStore) entry(requestID string) *failureCapture {
+	if c, ok := s.entries[requestID]; ok {
+		return c
+	}
+	for len(s.order) >= s.max {
+		delete(s.entries, s.order[0])
+		s.order = slices.Delete(s.order, 0, 1)
+	}
+	c := &failureCapture{capturedAt: time.Now().UTC()}
+	s.entries[requestID] = c
+	s.order = append(s.order, requestID)
+	return c
+}
+
+// putHAR records har as the network trace of requestID.
+func (s *failureStore) putHAR(requestID string, har []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entry(requestID).har = har
+}
+
+func (s *failureStore) har(requestID string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.entries[requestID]
+	if !ok || c.har == nil {
+		return nil, false
+	}
+	return c.har, true
+}
+
+func (s *failureStore) screenshot(requestID string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.entries[requestID]
+	if !ok || c.screenshot == nil {
+		return nil, false
+	}
+	return c.screenshot, true
+}
+
+// maskCredentialsJS blanks what the user typed before a screenshot is taken:
+// password, email/username and one-time code fields show bullets instead.
+const maskCredentialsJS = `
+	(function() {
+		var fields = document.querySelectorAll(
+			'input[type="password"], input[type="email"], input[name="username"], input[name="loginID"], ' +
+			'input[autocomplete="one-time-code"], input.gig-tfa-code-textbox, input[name="gigya-textbox-code"]');
+		Array.prototype.forEach.call(fields, function(el) {
+			if (el.value) { el.type = 'text'; el.value = '•'.repeat(8); }
+		});
+	})()
+`
+
+// captureFailureTrace stores the network trace of a failed login.
+func captureFailureTrace(trace *harRecorder, attempt oauthAttempt) {
+	if !failures.enabled() {
+		return
+	}
+	har, err := trace.har(attempt.email, attempt.password)
+	if err != nil {
+		log.Printf("[%s] Failure trace not captured: %v", attempt.requestID, err)
+		return
+	}
+	failures.putHAR(attempt.requestID, har)
+	log.Printf("[%s] Failure trace captured, see /debug/requests/%s/trace.har", attempt.requestID, attempt.requestID)
+}
+
+// captureFailureScreenshot stores a full-page screenshot of the browser for a
+// failed login, with the credential fields masked. It gives up after a few
+// seconds so a wedged page does not hold the browser session.
+func captureFailureScreenshot(browserCtx context.Context, requestID string) {
+	if !failures.enabled() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(browserCtx, 10*time.Second)
+	defer cancel()
+
+	var png []byte
+	if err := chromedp.Run(ctx,
+		chromedp.Evaluate(maskCredentialsJS, nil),
+		chromedp.FullScreenshot(&png, 100),
+	); err != nil {
+		log.Printf("[%s] Failure screenshot not captured: %v", requestID, err)
+		return
+	}
+	failures.putScreenshot(requestID, png)
+	log.Printf("[%s] Failure screenshot captured (%d bytes), see /debug/requests/%s/screenshot.png",
+		requestID, len(png), requestID)
+}
+
+func handleFailureScreenshot(w http.ResponseWriter, r *http.Request) {
+	png, ok := failures.screenshot(r.PathValue("requestID"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write(png)
+}
@@ -0,0 +1,48 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFailureStoreEvictsOldest(t *testing.T) {
+	store := newFailureStore(2)
+	store.putScreenshot("a", []byte("a"))
+	store.putScreenshot("b", []byte("b"))
+	store.putScreenshot("b", []byte("b2"))
+	store.putScreenshot("c", []byte("c"))
+
+	if _, ok := store.screenshot("a"); ok {
+		t.Error("oldest capture should have been evicted")
+	}
+	if png, ok := store.screenshot("b"); !ok || string(png) != "b2" {
+		t.Errorf("screenshot(b) = %q, %v; want b2", png, ok)
+	}
+	if _, ok := store.screenshot("c"); !ok {
+		t.Error("newest capture missing")
+	}
+}
+
+func TestFailureStoreDisabled(t *testing.T) {
+	if newFailureStore(0).enabled() {
+		t.Error("a store without room should be disabled")
+	}
+}
+
+func TestHandleFailureScreenshot(t *testing.T) {
+	setGlobal(t, &failures, newFailureStore(5)).putScreenshot("req", []byte("\x89PNG"))
+	mux := newMetricsMux(newOAuthMetrics().handler())
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/requests/req/screenshot.png", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" || w.Body.String() != "\x89PNG" {
+		t.Fatalf("status = %d, Content-Type = %q, body = %q", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/requests/other/screenshot.png", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown request: status = %d, want 404", w.Code)
+	}
+}
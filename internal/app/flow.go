@@ -0,0 +1,364 @@
+package app
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"time"
+
+	"github.com/chromedp/cdproto/input"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+)
+
+// flowsJSON holds the built-in login flows, keyed by brand with "default"
+// used for brands without their own.
+//
+//go:embed flows.json
+var flowsJSON []byte
+
+// defaultFlow is the flows.json key used for brands without their own flow.
+const defaultFlow = "default"
+
+// Login flow step actions.
+const (
+	stepNavigate     = "navigate"       // load the authorization URL
+	stepWaitVisible  = "wait-visible"   // wait for selector to be visible
+	stepInsertText   = "insert-text"    // focus selector and type value ("email" or "password")
+	stepJSClick      = "js-click"       // element.click() the first of selectors that is visible
+	stepSleep        = "sleep"          // pause for duration
+	stepWaitRedirect = "wait-redirect"  // wait up to timeout for the app redirect
+	stepCheckError   = "check-error"    // fail with the text of selector, if any
+	stepInput        = "input-required" // if one of selectors shows within timeout, ask the user for it
+)
+
+// loginFlows are the flows performChromedpOAuth runs (set up in Run).
+var loginFlows map[string]loginFlow
+
+// loginFlow is a versioned, declarative browser login script. Selectors are
+// CSS (chromedp.ByQuery).
+type loginFlow struct {
+	Version int        `json:"version"`
+	Steps   []flowStep `json:"steps"`
+}
+
+type flowStep struct {
+	Action string `json:"action"`
+	// Phase, when set, becomes the progress label from this step on.
+	Phase     string   `json:"phase,omitempty"`
+	Selector  string   `json:"selector,omitempty"`
+	Selectors []string `json:"selectors,omitempty"`
+	Value     string   `json:"value,omitempty"`
+	// Duration is how long sleep pauses; Timeout bounds waiting steps.
+	Duration flowDuration `json:"duration,omitempty"`
+	Timeout  flowDuration `json:"timeout,omitempty"`
+	// Error prefixes the error returned when the step fails.
+	Error string `json:"error,omitempty"`
+	// Optional steps end the script quietly when they fail; the outcome is then
+	// whatever the redirect listener captured.
+	Optional bool `json:"optional,omitempty"`
+	// Prompt is shown to the user by input-required; Submit, when set, is
+	// clicked after typing the answer (otherwise the field's form is submitted).
+	Prompt string `json:"prompt,omitempty"`
+	Submit string `json:"submit,omitempty"`
+	// Localized lets js-click also match buttons by the consent labels of the
+	// country's locale, then by text content (see consentLabels).
+	Localized bool `json:"localized,omitempty"`
+}
+
+// flowDuration is a time.Duration written as a string ("1500ms", "60s").
+type flowDuration time.Duration
+
+func (d *flowDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = flowDuration(v)
+	return nil
+}
+
+// loadLoginFlows parses the built-in flows and, when overridePath is set,
+// replaces them brand by brand with the flows from that file, so a changed
+// login page can be handled by mounting a file instead of a new release.
+func loadLoginFlows(overridePath string) (map[string]loginFlow, error) {
+	flows, err := parseLoginFlows(flowsJSON)
+	if err != nil {
+		return nil, fmt.Errorf("built-in flows: %w", err)
+	}
+	if overridePath == "" {
+		return flows, nil
+	}
+	data, err := os.ReadFile(overridePath)
+	if err != nil {
+		return nil, err
+	}
+	overrides, err := parseLoginFlows(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", overridePath, err)
+	}
+	maps.Copy(flows, overrides)
+	for name, flow := range overrides {
+		log.Printf("Login flow %s v%d loaded from %s", name, flow.Version, overridePath)
+	}
+	return flows, nil
+}
+
+func parseLoginFlows(data []byte) (map[string]loginFlow, error) {
+	var flows map[string]loginFlow
+	if err := json.Unmarshal(data, &flows); err != nil {
+		return nil, err
+	}
+	for name, flow := range flows {
+		if err := flow.validate(); err != nil {
+			return nil, fmt.Errorf("flow %s: %w", name, err)
+		}
+	}
+	return flows, nil
+}
+
+func (f loginFlow) validate() error {
+	if len(f.Steps) == 0 {
+		return errors.New("no steps")
+	}
+	for i, s := range f.Steps {
+		var err error
+		switch s.Action {
+		case stepNavigate:
+		case stepWaitVisible, stepCheckError:
+			if s.Selector == "" {
+				err = errors.New("selector is required")
+			}
+		case stepInsertText:
+			if s.Selector == "" {
+				err = errors.New("selector is required")
+			} else if s.Value != "email" && s.Value != "password" {
+				err = fmt.Errorf("value must be \"email\" or \"password\", got %q", s.Value)
+			}
+		case stepJSClick:
+			if len(s.Selectors) == 0 && !s.Localized {
+				err = errors.New("selectors are required")
+			} else if s.Localized && s.Timeout <= 0 {
+				err = errors.New("localized requires a timeout")
+			}
+		case stepInput:
+			if len(s.Selectors) == 0 {
+				err = errors.New("selectors are required")
+			} else if s.Prompt == "" {
+				err = errors.New("prompt is required")
+			}
+		case stepSleep:
+			if s.Duration <= 0 {
+				err = errors.New("duration is required")
+			}
+		case stepWaitRedirect:
+			if s.Timeout <= 0 {
+				err = errors.New("timeout is required")
+			}
+		default:
+			err = fmt.Errorf("unknown action %q", s.Action)
+		}
+		if err != nil {
+			return fmt.Errorf("step %d (%s): %w", i+1, s.Action, err)
+		}
+	}
+	return nil
+}
+
+// flowFor returns the login flow for brand, falling back to the default one.
+func flowFor(brand string) (string, loginFlow, error) {
+	if flow, ok := loginFlows[brand]; ok {
+		return brand, flow, nil
+	}
+	if flow, ok := loginFlows[defaultFlow]; ok {
+		return defaultFlow, flow, nil
+	}
+	return "", loginFlow{}, fmt.Errorf("no login flow for %s", brand)
+}
+
+// runLoginFlow executes flow in the browser. It stops early once done reports
+// that the redirect (or an error page) has arrived.
+func runLoginFlow(
+	browserCtx context.Context, flow loginFlow, attempt oauthAttempt,
+	setPhase func(string), done func() bool,
+) error {
+	for _, step := range flow.Steps {
+		if done() {
+			return nil
+		}
+		if step.Phase != "" {
+			setPhase(step.Phase)
+		}
+		err := runFlowStep(browserCtx, step, attempt, done)
+		if err == nil {
+			continue
+		}
+		if step.Optional {
+			log.Printf("[%s] Optional %s step did not complete: %v", attempt.requestID, step.Action, err)
+			return nil
+		}
+		if errors.Is(err, errAuthFailed) {
+			return err
+		}
+		if step.Error != "" {
+			return fmt.Errorf("%s: %w", step.Error, err)
+		}
+		return fmt.Errorf("%s step failed: %w", step.Action, err)
+	}
+	return nil
+}
+
+func runFlowStep(browserCtx context.Context, step flowStep, attempt oauthAttempt, done func() bool) error {
+	ctx := browserCtx
+	if step.Timeout > 0 && step.Action != stepWaitRedirect && step.Action != stepJSClick && step.Action != stepInput {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(browserCtx, time.Duration(step.Timeout))
+		defer cancel()
+	}
+
+	switch step.Action {
+	case stepNavigate:
+		return chromedp.Run(ctx,
+			network.Enable(),
+			chromedp.Navigate(attempt.authURL),
+			chromedp.WaitReady("body"),
+		)
+	case stepWaitVisible:
+		return chromedp.Run(ctx, chromedp.WaitVisible(step.Selector, chromedp.ByQuery))
+	case stepInsertText:
+		// Stellantis silently drops CDP synthetic key/mouse events on the Gigya
+		// login page, so type via Input.insertText into the focused field; it
+		// lands and fires the input event Gigya's validation listens for.
+		text := attempt.email
+		if step.Value == "password" {
+			text = attempt.password
+		}
+		return chromedp.Run(ctx, chromedp.Focus(step.Selector, chromedp.ByQuery), input.InsertText(text))
+	case stepSleep:
+		return chromedp.Run(ctx, chromedp.Sleep(time.Duration(step.Duration)))
+	case stepWaitRedirect:
+		deadline := time.Now().Add(time.Duration(step.Timeout))
+		for !done() && time.Now().Before(deadline) {
+			_ = chromedp.Run(ctx, chromedp.Sleep(500*time.Millisecond))
+		}
+		return nil
+	case stepCheckError:
+		var text string
+		_ = chromedp.Run(ctx, chromedp.Evaluate(fmt.Sprintf(`
+			(function() {
+				var error = document.querySelector(%s);
+				return error && error.textContent.trim() || '';
+			})()
+		`, jsString(step.Selector)), &text))
+		if text != "" {
+			return fmt.Errorf("%w: %s", errAuthFailed, text)
+		}
+		return nil
+	case stepJSClick:
+		return flowClick(browserCtx, step, attempt, done)
+	case stepInput:
+		return flowInput(browserCtx, step, attempt.requestID, done)
+	}
+	return fmt.Errorf("unknown action %q", step.Action)
+}
+
+// flowClick clicks the first of step.Selectors. Without a timeout it clicks
+// right away; with one, the selectors are scanned for a visible match until
+// the deadline, since some pages render slowly (notably Citroen's consent
+// page: heavy fonts/select2). Localized steps also try clickByLabel in each
+// round.
+func flowClick(browserCtx context.Context, step flowStep, attempt oauthAttempt, done func() bool) error {
+	requestID := attempt.requestID
+	if step.Timeout <= 0 {
+		return jsClick(browserCtx, step.Selectors[0])
+	}
+	deadline := time.Now().Add(time.Duration(step.Timeout))
+	for !done() && time.Now().Before(deadline) {
+		for _, selector := range step.Selectors {
+			checkCtx, checkCancel := context.WithTimeout(browserCtx, 1500*time.Millisecond)
+			err := chromedp.Run(checkCtx, chromedp.WaitVisible(selector, chromedp.ByQuery))
+			checkCancel()
+			if err == nil {
+				log.Printf("[%s] Clicking %s (matched by selector)", requestID, selector)
+				return jsClick(browserCtx, selector)
+			}
+		}
+		if step.Localized {
+			if matched, err := clickByLabel(browserCtx, attempt.locale); err == nil && matched != "" {
+				log.Printf("[%s] Clicked button matched by %s (locale %s)", requestID, matched, attempt.locale)
+				return nil
+			}
+			_ = chromedp.Run(browserCtx, chromedp.Sleep(500*time.Millisecond))
+		}
+	}
+	if done() {
+		return nil
+	}
+	return errors.New("no matching element became visible")
+}
+
+// flowInput handles verification screens (Gigya TFA, email codes): when one
+// of step.Selectors becomes visible within step.Timeout, the user is asked for
+// the code, which is typed into that field like the credentials. Without such
+// a screen the step does nothing.
+func flowInput(browserCtx context.Context, step flowStep, requestID string, done func() bool) error {
+	var field string
+	deadline := time.Now().Add(time.Duration(step.Timeout))
+	for field == "" && !done() {
+		_ = chromedp.Run(browserCtx, chromedp.Evaluate(fmt.Sprintf(`
+			(function() {
+				return %s.find(function(s) {
+					var el = document.querySelector(s);
+					return el && el.offsetParent !== null;
+				}) || '';
+			})()
+		`, jsStrings(step.Selectors)), &field))
+		if field != "" || !time.Now().Before(deadline) {
+			break
+		}
+		_ = chromedp.Run(browserCtx, chromedp.Sleep(500*time.Millisecond))
+	}
+	if field == "" {
+		return nil
+	}
+
+	log.Printf("[%s] Verification screen detected (%s)", requestID, field)
+	answer, err := inputs.request(browserCtx, requestID, step.Prompt)
+	if err != nil {
+		return err
+	}
+	if err := chromedp.Run(browserCtx, chromedp.Focus(field, chromedp.ByQuery), input.InsertText(answer)); err != nil {
+		return err
+	}
+	if step.Submit != "" {
+		return jsClick(browserCtx, step.Submit)
+	}
+	return chromedp.Run(browserCtx, chromedp.Evaluate(fmt.Sprintf(`
+		(function() {
+			var form = document.querySelector(%s).form;
+			if (form) { form.requestSubmit ? form.requestSubmit() : form.submit(); }
+		})()
+	`, jsString(field)), nil))
+}
+
+// jsStrings JSON-encodes ss as a script array literal.
+func jsStrings(ss []string) string {
+	b, _ := json.Marshal(ss)
+	return string(b)
+}
+
+// jsString JSON-encodes s for embedding in a script (selectors may contain
+// quotes/brackets).
+func jsString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
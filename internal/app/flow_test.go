@@ -0,0 +1,92 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuiltInLoginFlows(t *testing.T) {
+	flows, err := loadLoginFlows("")
+	if err != nil {
+		t.Fatalf("loadLoginFlows() error = %v", err)
+	}
+	flow, ok := flows[defaultFlow]
+	if !ok || flow.Version < 1 {
+		t.Fatalf("default flow missing or unversioned: %+v", flow)
+	}
+	var sawPassword, sawConsent bool
+	for _, step := range flow.Steps {
+		if step.Action == stepInsertText && step.Value == "password" {
+			sawPassword = true
+		}
+		if step.Action == stepJSClick && step.Optional && step.Localized && len(step.Selectors) > 1 && step.Selectors[0] == "#consentbutton" {
+			sawConsent = true
+		}
+	}
+	if !sawPassword || !sawConsent {
+		t.Errorf("default flow lacks the password or consent step: %+v", flow.Steps)
+	}
+}
+
+func TestLoadLoginFlowsOverride(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flows.json")
+	override := `{"MyCitroen": {"version": 7, "steps": [
+		{"action": "navigate"},
+		{"action": "wait-visible", "selector": "#login", "timeout": "30s"},
+		{"action": "wait-redirect", "timeout": "5s"}
+	]}}`
+	if err := os.WriteFile(path, []byte(override), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	flows, err := loadLoginFlows(path)
+	if err != nil {
+		t.Fatalf("loadLoginFlows() error = %v", err)
+	}
+	if _, ok := flows[defaultFlow]; !ok {
+		t.Error("override dropped the built-in default flow")
+	}
+	citroen := flows["MyCitroen"]
+	if citroen.Version != 7 || time.Duration(citroen.Steps[1].Timeout) != 30*time.Second {
+		t.Errorf("override not applied: %+v", citroen)
+	}
+
+	orig := loginFlows
+	loginFlows = flows
+	t.Cleanup(func() { loginFlows = orig })
+	if name, _, _ := flowFor("MyCitroen"); name != "MyCitroen" {
+		t.Errorf("flowFor(MyCitroen) = %q", name)
+	}
+	if name, _, _ := flowFor("MyPeugeot"); name != defaultFlow {
+		t.Errorf("flowFor(MyPeugeot) = %q, want default", name)
+	}
+}
+
+func TestParseLoginFlowsValidates(t *testing.T) {
+	cases := map[string]string{
+		"unknown action":   `{"x": {"steps": [{"action": "teleport"}]}}`,
+		"missing selector": `{"x": {"steps": [{"action": "wait-visible"}]}}`,
+		"bad value":        `{"x": {"steps": [{"action": "insert-text", "selector": "#a", "value": "otp"}]}}`,
+		"bad duration":     `{"x": {"steps": [{"action": "sleep", "duration": "soon"}]}}`,
+		"no steps":         `{"x": {"version": 1}}`,
+		"missing prompt":   `{"x": {"steps": [{"action": "input-required", "selectors": ["#code"]}]}}`,
+		"untimed labels":   `{"x": {"steps": [{"action": "js-click", "localized": true}]}}`,
+	}
+	for name, doc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseLoginFlows([]byte(doc)); err == nil {
+				t.Errorf("parseLoginFlows(%s) error = nil", doc)
+			}
+		})
+	}
+}
+
+func TestLoadLoginFlowsMissingFile(t *testing.T) {
+	_, err := loadLoginFlows(filepath.Join(t.TempDir(), "missing.json"))
+	if err == nil || !strings.Contains(err.Error(), "missing.json") {
+		t.Errorf("loadLoginFlows() error = %v, want missing file", err)
+	}
+}
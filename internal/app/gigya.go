@@ -0,0 +1,162 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+)
+
+// gigyaLoginResponse is the subset of accounts.login's response we consume.
+type gigyaLoginResponse struct {
+	ErrorCode    int    `json:"errorCode"`
+	ErrorMessage string `json:"errorMessage"`
+	ErrorDetails string `json:"errorDetails"`
+	SessionInfo  struct {
+		LoginToken string `json:"login_token"`
+	} `json:"sessionInfo"`
+}
+
+// gigyaPendingCodes are errorCodes with which Gigya continues the login on
+// another screen instead of failing it: pending registration, pending email
+// verification, pending two-factor verification and registration.
+var gigyaPendingCodes = []int{206001, 206002, 403101, 403102}
+
+// gigyaRejectedCodes are errorCodes with which Gigya turns down the
+// credentials themselves: invalid loginID or password, unknown loginID and a
+// previously used password.
+var gigyaRejectedCodes = []int{403042, 403047, 401030}
+
+// parseGigyaResponse decodes a Gigya API response, which the web SDK may
+// receive wrapped in a JSONP callback.
+func parseGigyaResponse(body []byte) (gigyaLoginResponse, error) {
+	var gr gigyaLoginResponse
+	start, end := bytes.IndexByte(body, '{'), bytes.LastIndexByte(body, '}')
+	if start < 0 || end < start {
+		return gr, fmt.Errorf("parsing gigya login response: no JSON object in %d bytes", len(body))
+	}
+	if err := json.Unmarshal(body[start:end+1], &gr); err != nil {
+		return gr, fmt.Errorf("parsing gigya login response: %w", err)
+	}
+	return gr, nil
+}
+
+// err returns the failure the response reports, or nil when it has none.
+func (r gigyaLoginResponse) err() error {
+	if r.ErrorCode == 0 {
+		return nil
+	}
+	msg := r.ErrorDetails
+	if msg == "" {
+		msg = r.ErrorMessage
+	}
+	return gigyaError(r.ErrorCode, msg)
+}
+
+// gigyaError maps a Gigya errorCode onto the failure it stands for. Any other
+// code (server errors, invalid parameters, a bad API key) is a plain
+// errAuthFailed, which another executor may still get past.
+func gigyaError(code int, msg string) error {
+	switch {
+	case code == 403120, code == 403041: // account temporarily locked out, account disabled
+		return fmt.Errorf("%w: %s", errAccountLocked, msg)
+	case code == 401020, code == 401021: // captcha required, wrong captcha
+		return fmt.Errorf("%w: %s", errCaptchaBlocked, msg)
+	case slices.Contains(gigyaPendingCodes, code):
+		// Only the browser can go on to the verification screen.
+		return fmt.Errorf("%w (%s)", errNoInteractiveInput, msg)
+	case slices.Contains(gigyaRejectedCodes, code):
+		return fmt.Errorf("%w: %s", errCredentialsRejected, msg)
+	}
+	return fmt.Errorf("%w: gigya errorCode %d: %s", errAuthFailed, code, msg)
+}
+
+// gigyaLoginWatch reads the responses of the login page's accounts.login
+// calls, so a rejected login fails as soon as Gigya answers, with its exact
+// reason, instead of after the redirect wait and a look for error text in
+// the page. Feed it every event from the chromedp.ListenTarget callback.
+type gigyaLoginWatch struct {
+	browserCtx context.Context
+	requestID  string
+
+	calls map[network.RequestID]bool // only touched by the listener
+
+	mu  sync.Mutex
+	err error
+}
+
+func newGigyaLoginWatch(browserCtx context.Context, requestID string) *gigyaLoginWatch {
+	return &gigyaLoginWatch{
+		browserCtx: browserCtx,
+		requestID:  requestID,
+		calls:      make(map[network.RequestID]bool),
+	}
+}
+
+func isGigyaLoginURL(u string) bool {
+	return strings.Contains(u, "gigya.com/accounts.login") || strings.Contains(u, "/accounts.login?")
+}
+
+func (g *gigyaLoginWatch) observe(ev any) {
+	switch e := ev.(type) {
+	case *network.EventResponseReceived:
+		if e.Response != nil && isGigyaLoginURL(e.Response.URL) {
+			g.calls[e.RequestID] = true
+		}
+	case *network.EventLoadingFinished:
+		if !g.calls[e.RequestID] {
+			return
+		}
+		delete(g.calls, e.RequestID)
+		// CDP commands cannot be issued from within the listener.
+		go g.check(e.RequestID)
+	}
+}
+
+func (g *gigyaLoginWatch) check(id network.RequestID) {
+	var body []byte
+	err := chromedp.Run(g.browserCtx, chromedp.ActionFunc(func(ctx context.Context) error {
+		var err error
+		body, err = network.GetResponseBody(id).Do(ctx)
+		return err
+	}))
+	if err != nil {
+		if g.browserCtx.Err() == nil {
+			log.Printf("[%s] Could not read the Gigya login response: %v", g.requestID, err)
+		}
+		return
+	}
+	gr, err := parseGigyaResponse(body)
+	if err != nil {
+		log.Printf("[%s] %v", g.requestID, err)
+		return
+	}
+	// Only a definite rejection ends the login; on anything else the page
+	// may still recover or show its own error.
+	loginErr := gr.err()
+	if !errors.Is(loginErr, errCredentialsRejected) && !errors.Is(loginErr, errCaptchaBlocked) {
+		log.Printf("[%s] Gigya login response: errorCode %d (%s)", g.requestID, gr.ErrorCode, gr.ErrorMessage)
+		return
+	}
+	log.Printf("[%s] Gigya login failed: errorCode %d (%s)", g.requestID, gr.ErrorCode, gr.ErrorMessage)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.err == nil {
+		g.err = loginErr
+	}
+}
+
+// failed returns the error of a rejected login, if Gigya reported one.
+func (g *gigyaLoginWatch) failed() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.err
+}
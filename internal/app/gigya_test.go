@@ -0,0 +1,73 @@
+package app
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseGigyaResponse(t *testing.T) {
+	bodies := map[string]string{
+		"json":  `{"errorCode":403042,"errorMessage":"Invalid LoginID","errorDetails":"invalid loginID or password"}`,
+		"jsonp": `gigya.callback({"errorCode":403042,"errorMessage":"Invalid LoginID","errorDetails":"invalid loginID or password"});`,
+	}
+	for name, body := range bodies {
+		t.Run(name, func(t *testing.T) {
+			gr, err := parseGigyaResponse([]byte(body))
+			if err != nil {
+				t.Fatalf("parseGigyaResponse() error = %v", err)
+			}
+			if gr.ErrorCode != 403042 || gr.ErrorDetails != "invalid loginID or password" {
+				t.Errorf("response = %+v", gr)
+			}
+		})
+	}
+
+	if _, err := parseGigyaResponse([]byte("<html>")); err == nil {
+		t.Error("parseGigyaResponse(html) error = nil")
+	}
+}
+
+func TestGigyaResponseErr(t *testing.T) {
+	cases := map[int]errorCode{
+		403042: codeInvalidCredentials,
+		403120: codeAccountLocked,
+		401020: codeCaptchaBlocked,
+		403101: codeVerificationRequired,
+		403047: codeInvalidCredentials,
+		400006: codeAuthFailed, // invalid parameter value
+		403007: codeAuthFailed, // invalid API key
+		500001: codeAuthFailed, // general server error
+	}
+	for code, want := range cases {
+		err := gigyaLoginResponse{ErrorCode: code, ErrorMessage: "message"}.err()
+		if got := errorCodeOf(err); got != want {
+			t.Errorf("errorCode %d: error code = %q (%v), want %q", code, got, err, want)
+		}
+	}
+	if err := (gigyaLoginResponse{}).err(); err != nil {
+		t.Errorf("errorCode 0: err() = %v, want nil", err)
+	}
+	// A locked account must not be retried with another executor.
+	if err := (gigyaLoginResponse{ErrorCode: 403120}).err(); !errors.Is(err, errCredentialsRejected) {
+		t.Errorf("locked account error = %v, want errCredentialsRejected", err)
+	}
+	// Gigya failing is no verdict on the credentials, so fallback goes on.
+	for _, code := range []int{400006, 500001, 123456} {
+		if err := (gigyaLoginResponse{ErrorCode: code}).err(); errors.Is(err, errCredentialsRejected) {
+			t.Errorf("errorCode %d: err() = %v, want no credential rejection", code, err)
+		}
+	}
+}
+
+func TestIsGigyaLoginURL(t *testing.T) {
+	for u, want := range map[string]bool{
+		"https://accounts.eu1.gigya.com/accounts.login":          true,
+		"https://login.mypeugeot.com/accounts.login?context=1":   true,
+		"https://accounts.eu1.gigya.com/accounts.getAccountInfo": false,
+		"https://idpcvs.peugeot.com/am/oauth2/authorize":         false,
+	} {
+		if got := isGigyaLoginURL(u); got != want {
+			t.Errorf("isGigyaLoginURL(%q) = %v, want %v", u, got, want)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package app
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/network"
+)
+
+// harMaxEntries bounds how many requests one login trace records.
+const harMaxEntries = 1000
+
+// harRedacted replaces secrets in recorded traces.
+const harRedacted = "[REDACTED]"
+
+// harSecretHeaders are header names whose values are always redacted.
+var harSecretHeaders = []string{"cookie", "set-cookie", "authorization", "proxy-authorization"}
+
+// harSecretParamRE finds query/form/cookie parameters carrying credentials,
+// authorization codes or tokens, e.g. "code=..." or "glt_3_abc=...".
+var harSecretParamRE = regexp.MustCompile(
+	`(?i)\b(code|code_verifier|password|login_token|access_token|refresh_token|id_token|client_secret|glt_[\w-]+)=([^&\s;"']+)`)
+
+// harRecorder assembles the browser's network traffic during a login into a
+// HAR 1.2 log, fed from the chromedp.ListenTarget callback.
+type harRecorder struct {
+	mu      sync.Mutex
+	entries []*harRecord
+	open    map[network.RequestID]*harRecord
+}
+
+// harRecord is one request as seen over CDP, until it becomes a harEntry.
+type harRecord struct {
+	request   *network.Request
+	started   time.Time // wall clock
+	startedAt float64   // monotonic seconds
+	endedAt   float64   // monotonic seconds, 0 while in flight
+	response  *network.Response
+	size      float64 // encoded bytes received
+	err       string
+}
+
+func newHARRecorder() *harRecorder {
+	return &harRecorder{open: make(map[network.RequestID]*harRecord)}
+}
+
+// observe records the network events among ev; others are ignored.
+func (h *harRecorder) observe(ev any) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch e := ev.(type) {
+	case *network.EventRequestWillBeSent:
+		// A redirect reuses the request ID: the previous hop ends here with the
+		// redirect response.
+		if prev, ok := h.open[e.RequestID]; ok && e.RedirectResponse != nil {
+			prev.response = e.RedirectResponse
+			prev.endedAt = monotonicSeconds(e.Timestamp)
+		}
+		if len(h.entries) >= harMaxEntries || e.Request == nil {
+			delete(h.open, e.RequestID)
+			return
+		}
+		r := &harRecord{request: e.Request, startedAt: monotonicSeconds(e.Timestamp)}
+		if e.WallTime != nil {
+			r.started = e.WallTime.Time()
+		}
+		h.entries = append(h.entries, r)
+		h.open[e.RequestID] = r
+	case *network.EventResponseReceived:
+		if r, ok := h.open[e.RequestID]; ok {
+			r.response = e.Response
+		}
+	case *network.EventLoadingFinished:
+		if r, ok := h.open[e.RequestID]; ok {
+			r.endedAt = monotonicSeconds(e.Timestamp)
+			r.size = e.EncodedDataLength
+			delete(h.open, e.RequestID)
+		}
+	case *network.EventLoadingFailed:
+		if r, ok := h.open[e.RequestID]; ok {
+			r.endedAt = monotonicSeconds(e.Timestamp)
+			r.err = e.ErrorText
+			delete(h.open, e.RequestID)
+		}
+	}
+}
+
+// monotonicSeconds returns t in CDP's own clock, the one ResourceTiming's
+// RequestTime uses.
+func monotonicSeconds(t *cdp.MonotonicTime) float64 {
+	if t == nil {
+		return 0
+	}
+	return t.Time().Sub(*cdp.MonotonicTimeEpoch).Seconds()
+}
+
+// HAR 1.2 (http://www.softwareishard.com/blog/har-12-spec/), the subset we
+// fill in. Fields prefixed with "_" are custom, as the spec allows.
+type harLog struct {
+	Log struct {
+		Version string     `json:"version"`
+		Creator harCreator `json:"creator"`
+		Pages   []any      `json:"pages"`
+		Entries []harEntry `json:"entries"`
+		Comment string     `json:"comment,omitempty"`
+	} `json:"log"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Error           string      `json:"_error,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int64          `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// har renders the recorded traffic as a HAR document. Cookies, credential
+// headers, authorization codes, tokens and the given literal secrets (the
+// user's email and password) are replaced with [REDACTED]; response bodies are
+// not recorded at all.
+func (h *harRecorder) har(secrets ...string) ([]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	redact := harRedactor(secrets)
+	var doc harLog
+	doc.Log.Version = "1.2"
+	doc.Log.Creator = harCreator{Name: "stelloauth", Version: "1"}
+	doc.Log.Pages = []any{}
+	doc.Log.Entries = make([]harEntry, 0, len(h.entries))
+	if len(h.entries) >= harMaxEntries {
+		doc.Log.Comment = fmt.Sprintf("truncated after %d requests", harMaxEntries)
+	}
+	for _, r := range h.entries {
+		doc.Log.Entries = append(doc.Log.Entries, r.entry(redact))
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+func (r *harRecord) entry(redact func(string) string) harEntry {
+	req := r.request
+	e := harEntry{
+		StartedDateTime: r.started.UTC().Format(time.RFC3339Nano),
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         redact(req.URL),
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(req.Headers, redact),
+			QueryString: harQuery(req.URL, redact),
+			HeadersSize: -1,
+			BodySize:    0,
+		},
+		Response: harResponse{
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []harNameValue{},
+			Headers:     []harNameValue{},
+			Content:     harContent{Comment: "bodies are not recorded"},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Timings: harTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1},
+		Error:   r.err,
+	}
+	if req.HasPostData {
+		body := postDataText(req.PostDataEntries)
+		e.Request.BodySize = len(body)
+		mimeType, _ := req.Headers["Content-Type"].(string)
+		e.Request.PostData = &harPostData{MimeType: mimeType, Text: redact(body)}
+	}
+
+	if r.endedAt > 0 {
+		e.Time = (r.endedAt - r.startedAt) * 1000
+	}
+	e.Timings.Wait = e.Time
+	if resp := r.response; resp != nil {
+		e.Response.Status = resp.Status
+		e.Response.StatusText = resp.StatusText
+		if resp.Protocol != "" {
+			e.Response.HTTPVersion = strings.ToUpper(resp.Protocol)
+			e.Request.HTTPVersion = e.Response.HTTPVersion
+		}
+		e.Response.Headers = harHeaders(resp.Headers, redact)
+		if location, ok := resp.Headers["Location"].(string); ok {
+			e.Response.RedirectURL = redact(location)
+		} else if location, ok := resp.Headers["location"].(string); ok {
+			e.Response.RedirectURL = redact(location)
+		}
+		e.Response.Content.MimeType = resp.MimeType
+		e.Response.Content.Size = int(r.size)
+		e.Response.BodySize = int(r.size)
+		if t := resp.Timing; t != nil {
+			e.Timings = resourceTimings(t, r.endedAt, e.Time)
+		}
+	}
+	return e
+}
+
+// resourceTimings converts CDP's resource timing (milliseconds relative to
+// RequestTime, -1 when not applicable) into HAR phases.
+func resourceTimings(t *network.ResourceTiming, endedAt, total float64) harTimings {
+	phase := func(start, end float64) float64 {
+		if start < 0 || end < start {
+			return -1
+		}
+		return end - start
+	}
+	timings := harTimings{
+		DNS:     phase(t.DNSStart, t.DNSEnd),
+		Connect: phase(t.ConnectStart, t.ConnectEnd),
+		SSL:     phase(t.SslStart, t.SslEnd),
+		Send:    max(phase(t.SendStart, t.SendEnd), 0),
+		Wait:    max(phase(t.SendEnd, t.ReceiveHeadersEnd), 0),
+		Blocked: -1,
+	}
+	// Queueing lasts until the first phase that happened.
+	for _, start := range []float64{t.DNSStart, t.ConnectStart, t.SendStart} {
+		if start >= 0 {
+			timings.Blocked = start
+			break
+		}
+	}
+	if endedAt > 0 {
+		timings.Receive = max((endedAt-t.RequestTime)*1000-t.ReceiveHeadersEnd, 0)
+	} else {
+		timings.Receive = max(total-timings.Send-timings.Wait, 0)
+	}
+	return timings
+}
+
+// harRedactor returns a func scrubbing secret parameters and the literal
+// secrets (also in their URL-encoded forms) from a string.
+func harRedactor(secrets []string) func(string) string {
+	var literals []string
+	for _, s := range secrets {
+		if s == "" {
+			continue
+		}
+		literals = append(literals, s, url.QueryEscape(s), url.PathEscape(s))
+	}
+	// Longest first, so an encoded form is not half-replaced by a shorter one.
+	slices.SortFunc(literals, func(a, b string) int { return len(b) - len(a) })
+	return func(s string) string {
+		for _, l := range literals {
+			s = strings.ReplaceAll(s, l, harRedacted)
+		}
+		return harSecretParamRE.ReplaceAllString(s, "${1}="+harRedacted)
+	}
+}
+
+func harHeaders(headers network.Headers, redact func(string) string) []harNameValue {
+	out := make([]harNameValue, 0, len(headers))
+	for name, v := range headers {
+		value := fmt.Sprint(v)
+		if slices.Contains(harSecretHeaders, strings.ToLower(name)) {
+			value = harRedacted
+		}
+		out = append(out, harNameValue{Name: name, Value: redact(value)})
+	}
+	slices.SortFunc(out, func(a, b harNameValue) int { return strings.Compare(a.Name, b.Name) })
+	return out
+}
+
+func harQuery(rawURL string, redact func(string) string) []harNameValue {
+	out := []harNameValue{}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return out
+	}
+	for _, pair := range strings.Split(u.RawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(redact(pair), "=")
+		if n, err := url.QueryUnescape(name); err == nil {
+			name = n
+		}
+		if v, err := url.QueryUnescape(value); err == nil {
+			value = v
+		}
+		out = append(out, harNameValue{Name: name, Value: value})
+	}
+	return out
+}
+
+// postDataText joins the request body entries, which CDP sends base64-encoded.
+func postDataText(entries []*network.PostDataEntry) string {
+	var b strings.Builder
+	for _, e := range entries {
+		if e == nil {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(e.Bytes)
+		if err != nil {
+			continue
+		}
+		b.Write(data)
+	}
+	return b.String()
+}
+
+func handleFailureHAR(w http.ResponseWriter, r *http.Request) {
+	requestID := r.PathValue("requestID")
+	har, ok := failures.har(requestID)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", requestID+".har"))
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write(har)
+}
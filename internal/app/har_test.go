@@ -0,0 +1,107 @@
+package app
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/network"
+)
+
+func monotonic(seconds float64) *cdp.MonotonicTime {
+	t := cdp.MonotonicTime(cdp.MonotonicTimeEpoch.Add(time.Duration(seconds * float64(time.Second))))
+	return &t
+}
+
+// recordTestLogin feeds the recorder a login POST that redirects to the app
+// with a code, as seen over CDP.
+func recordTestLogin() *harRecorder {
+	wall := cdp.TimeSinceEpoch(time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC))
+	body := "loginID=driver%40example.com&password=s3cret%21"
+	h := newHARRecorder()
+	h.observe(&network.EventRequestWillBeSent{
+		RequestID: "1",
+		Timestamp: monotonic(100),
+		WallTime:  &wall,
+		Request: &network.Request{
+			URL:             "https://idp.example/login?goto=%2Fauthorize",
+			Method:          http.MethodPost,
+			Headers:         network.Headers{"Cookie": "glt_3_key=login-token", "Content-Type": "application/x-www-form-urlencoded"},
+			HasPostData:     true,
+			PostDataEntries: []*network.PostDataEntry{{Bytes: base64.StdEncoding.EncodeToString([]byte(body))}},
+		},
+	})
+	h.observe(&network.EventRequestWillBeSent{
+		RequestID: "1",
+		Timestamp: monotonic(100.25),
+		WallTime:  &wall,
+		Request:   &network.Request{URL: "mymap://oauth2redirect/de?code=the-code&state=s", Method: http.MethodGet},
+		RedirectResponse: &network.Response{
+			Status:   http.StatusFound,
+			Headers:  network.Headers{"Location": "mymap://oauth2redirect/de?code=the-code&state=s", "Set-Cookie": "session=abc"},
+			Protocol: "http/1.1",
+		},
+	})
+	h.observe(&network.EventLoadingFailed{RequestID: "1", Timestamp: monotonic(100.3), ErrorText: "net::ERR_UNKNOWN_URL_SCHEME"})
+	h.observe(&network.EventLoadingFinished{RequestID: "ignored", Timestamp: monotonic(101)})
+	return h
+}
+
+func TestHARRecorderRedacts(t *testing.T) {
+	har, err := recordTestLogin().har("driver@example.com", "s3cret!")
+	if err != nil {
+		t.Fatalf("har() error = %v", err)
+	}
+	for _, secret := range []string{"driver", "s3cret", "the-code", "login-token", "session=abc"} {
+		if strings.Contains(string(har), secret) {
+			t.Errorf("trace contains %q:\n%s", secret, har)
+		}
+	}
+
+	var doc harLog
+	if err := json.Unmarshal(har, &doc); err != nil {
+		t.Fatalf("trace is not JSON: %v", err)
+	}
+	if doc.Log.Version != "1.2" || len(doc.Log.Entries) != 2 {
+		t.Fatalf("log = version %q with %d entries, want 1.2 with 2", doc.Log.Version, len(doc.Log.Entries))
+	}
+	login, redirect := doc.Log.Entries[0], doc.Log.Entries[1]
+	if login.Response.Status != http.StatusFound || login.Response.RedirectURL != "mymap://oauth2redirect/de?code=[REDACTED]&state=s" {
+		t.Errorf("login response = %+v", login.Response)
+	}
+	if login.Time < 249 || login.Time > 251 {
+		t.Errorf("login time = %v ms, want 250", login.Time)
+	}
+	if login.Request.PostData == nil || !strings.Contains(login.Request.PostData.Text, "password=[REDACTED]") {
+		t.Errorf("login post data = %+v", login.Request.PostData)
+	}
+	if login.StartedDateTime != "2026-01-01T12:00:00Z" {
+		t.Errorf("startedDateTime = %q", login.StartedDateTime)
+	}
+	if redirect.Error != "net::ERR_UNKNOWN_URL_SCHEME" || redirect.Response.Status != 0 {
+		t.Errorf("redirect entry = %+v", redirect)
+	}
+}
+
+func TestHandleFailureHAR(t *testing.T) {
+	har, _ := recordTestLogin().har()
+	setGlobal(t, &failures, newFailureStore(5)).putHAR("req", har)
+	mux := newMetricsMux(newOAuthMetrics().handler())
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/requests/req/trace.har", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Header().Get("Content-Disposition"), "req.har") {
+		t.Fatalf("status = %d, Content-Disposition = %q", w.Code, w.Header().Get("Content-Disposition"))
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/requests/other/trace.har", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown request: status = %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,244 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// haDomain is the Home Assistant domain of the Stellantis Vehicles integration.
+const haDomain = "stellantis_vehicles"
+
+// Export formats accepted by /oauth?format=. The default (empty) format
+// returns no export.
+const (
+	exportFormatHA      = "ha"      // the config flow's field values as JSON
+	exportFormatStorage = "storage" // a .storage/core.config_entries entry
+)
+
+// validExportFormat reports whether format is a known /oauth?format= value.
+func validExportFormat(format string) bool {
+	switch format {
+	case "", exportFormatHA, exportFormatStorage:
+		return true
+	}
+	return false
+}
+
+// haFlowData maps an OAuth result onto the field names the integration's
+// config flow uses. Our brand keys are the integration's mobile_app values
+// (both come from the same Stellantis app configs). Tokens are included when
+// the code was exchanged.
+func haFlowData(brand, country string, data *OAuthData) map[string]any {
+	fields := map[string]any{
+		"mobile_app":   brand,
+		"country_code": country,
+	}
+	if data.Code != "" {
+		fields["oauth_code"] = data.Code
+	}
+	if data.AccessToken != "" {
+		fields["access_token"] = data.AccessToken
+		fields["refresh_token"] = data.RefreshToken
+		fields["expires_in"] = data.ExpiresIn
+	}
+	return fields
+}
+
+// renderExport builds the export for format, or nil for the default format.
+func renderExport(format, brand, country string, data *OAuthData) (any, error) {
+	switch format {
+	case "":
+		return nil, nil
+	case exportFormatHA:
+		return haFlowData(brand, country, data), nil
+	case exportFormatStorage:
+		// A config entry as stored in .storage/core.config_entries; Home
+		// Assistant fills in entry_id and timestamps when it loads the entry.
+		return map[string]any{
+			"domain":                    haDomain,
+			"title":                     brand + " (" + country + ")",
+			"data":                      haFlowData(brand, country, data),
+			"options":                   map[string]any{},
+			"pref_disable_new_entities": false,
+			"pref_disable_polling":      false,
+			"source":                    "user",
+			"unique_id":                 nil,
+			"disabled_by":               nil,
+			"version":                   1,
+			"minor_version":             1,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown export format: %s", format)
+}
+
+// HomeAssistantTarget is a Home Assistant instance to continue the Stellantis
+// Vehicles config flow on, authenticated with a long-lived access token.
+type HomeAssistantTarget struct {
+	URL   string `json:"url"`
+	Token string `json:"token"`
+}
+
+// HomeAssistantResult reports how far the pushed config flow got. Status is
+// "created" (entry added), "pending" (the flow needs input we cannot supply;
+// finish it in Home Assistant) or "failed" (Error says why; the code is still
+// in the response and can be pasted manually).
+type HomeAssistantResult struct {
+	Status  string `json:"status"`
+	FlowID  string `json:"flow_id,omitempty"`
+	StepID  string `json:"step_id,omitempty"`
+	EntryID string `json:"entry_id,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+const (
+	haStatusCreated = "created"
+	haStatusPending = "pending"
+	haStatusFailed  = "failed"
+)
+
+// haMaxSteps bounds how many config flow steps we drive before giving up.
+const haMaxSteps = 6
+
+var (
+	haClient = &http.Client{Timeout: 15 * time.Second}
+	// haDefaultTarget is the operator-configured instance every code is pushed
+	// to (nil when HOME_ASSISTANT_URL is unset).
+	haDefaultTarget *HomeAssistantTarget
+	// haAllowUserTargets lets requests name their own instance. Off by default:
+	// on a shared server it would let anyone make us POST to arbitrary URLs.
+	haAllowUserTargets bool
+)
+
+func initHomeAssistant() {
+	haAllowUserTargets = os.Getenv("HOME_ASSISTANT_ALLOW_USER_TARGETS") == "true"
+	haURL := os.Getenv("HOME_ASSISTANT_URL")
+	if haURL == "" {
+		haDefaultTarget = nil
+		return
+	}
+	haDefaultTarget = &HomeAssistantTarget{URL: haURL, Token: os.Getenv("HOME_ASSISTANT_TOKEN")}
+	log.Printf("Home Assistant push enabled: %s", haURL)
+}
+
+// homeAssistantTarget picks the instance to push req's code to: the one named
+// in the request, else the operator default, else none.
+func homeAssistantTarget(req OAuthRequest) *HomeAssistantTarget {
+	if req.HomeAssistant != nil {
+		return req.HomeAssistant
+	}
+	return haDefaultTarget
+}
+
+// haFlowStep is the subset of Home Assistant's config flow result we consume.
+type haFlowStep struct {
+	Type       string            `json:"type"`
+	FlowID     string            `json:"flow_id"`
+	StepID     string            `json:"step_id"`
+	Reason     string            `json:"reason"`
+	Errors     map[string]string `json:"errors"`
+	DataSchema []struct {
+		Name     string `json:"name"`
+		Required bool   `json:"required"`
+	} `json:"data_schema"`
+	Result struct {
+		EntryID string `json:"entry_id"`
+	} `json:"result"`
+}
+
+// pushToHomeAssistant starts the integration's config flow on target and
+// answers each form step from the OAuth result (see haFlowData) until the
+// entry is created or a step asks for something we do not have.
+func pushToHomeAssistant(
+	ctx context.Context, client *http.Client, target *HomeAssistantTarget, brand, country string, data *OAuthData,
+) *HomeAssistantResult {
+	values := haFlowData(brand, country, data)
+	base := strings.TrimRight(target.URL, "/") + "/api/config/config_entries/flow"
+
+	step, err := haFlowRequest(ctx, client, target, base, map[string]any{"handler": haDomain, "show_advanced_options": false})
+	if err != nil {
+		return &HomeAssistantResult{Status: haStatusFailed, Error: err.Error()}
+	}
+
+	for range haMaxSteps {
+		res := &HomeAssistantResult{FlowID: step.FlowID, StepID: step.StepID}
+		switch step.Type {
+		case "create_entry":
+			res.Status = haStatusCreated
+			res.EntryID = step.Result.EntryID
+			return res
+		case "abort":
+			res.Status = haStatusFailed
+			res.Error = "Home Assistant aborted the flow: " + step.Reason
+			return res
+		case "form":
+		default:
+			res.Status = haStatusPending
+			return res
+		}
+		if len(step.Errors) > 0 {
+			res.Status = haStatusFailed
+			res.Error = fmt.Sprintf("Home Assistant rejected step %s: %v", step.StepID, step.Errors)
+			return res
+		}
+
+		input := make(map[string]any)
+		for _, field := range step.DataSchema {
+			if v, ok := values[field.Name]; ok {
+				input[field.Name] = v
+			} else if field.Required {
+				res.Status = haStatusPending
+				return res
+			}
+		}
+		if len(input) == 0 {
+			res.Status = haStatusPending
+			return res
+		}
+
+		if step, err = haFlowRequest(ctx, client, target, base+"/"+url.PathEscape(step.FlowID), input); err != nil {
+			res.Status = haStatusFailed
+			res.Error = err.Error()
+			return res
+		}
+	}
+	return &HomeAssistantResult{Status: haStatusPending, FlowID: step.FlowID, StepID: step.StepID}
+}
+
+// haFlowRequest POSTs body to a config flow endpoint and decodes the step.
+func haFlowRequest(
+	ctx context.Context, client *http.Client, target *HomeAssistantTarget, endpoint string, body map[string]any,
+) (*haFlowStep, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+target.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("reaching Home Assistant: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d from Home Assistant", resp.StatusCode)
+	}
+
+	var step haFlowStep
+	if err := json.NewDecoder(resp.Body).Decode(&step); err != nil {
+		return nil, fmt.Errorf("parsing Home Assistant response: %w", err)
+	}
+	return &step, nil
+}
@@ -0,0 +1,188 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRenderExportHA(t *testing.T) {
+	got, err := renderExport(exportFormatHA, "MyPeugeot", "DE", &OAuthData{Code: "abc"})
+	if err != nil {
+		t.Fatalf("renderExport() error = %v", err)
+	}
+	fields := got.(map[string]any)
+	if fields["mobile_app"] != "MyPeugeot" || fields["country_code"] != "DE" || fields["oauth_code"] != "abc" {
+		t.Errorf("unexpected export: %v", fields)
+	}
+	if _, ok := fields["access_token"]; ok {
+		t.Error("tokens exported without an exchange")
+	}
+}
+
+func TestRenderExportStorageWithTokens(t *testing.T) {
+	data := &OAuthData{Code: "abc", AccessToken: "at", RefreshToken: "rt", ExpiresIn: 3600}
+	got, err := renderExport(exportFormatStorage, "MyOpel", "FR", data)
+	if err != nil {
+		t.Fatalf("renderExport() error = %v", err)
+	}
+
+	b, _ := json.Marshal(got)
+	var entry struct {
+		Domain string         `json:"domain"`
+		Title  string         `json:"title"`
+		Source string         `json:"source"`
+		Data   map[string]any `json:"data"`
+	}
+	if err := json.Unmarshal(b, &entry); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if entry.Domain != haDomain || entry.Title != "MyOpel (FR)" || entry.Source != "user" {
+		t.Errorf("unexpected entry: %s", b)
+	}
+	if entry.Data["access_token"] != "at" || entry.Data["refresh_token"] != "rt" || entry.Data["mobile_app"] != "MyOpel" {
+		t.Errorf("unexpected entry data: %v", entry.Data)
+	}
+}
+
+func TestRenderExportDefaultAndUnknown(t *testing.T) {
+	if got, err := renderExport("", "MyPeugeot", "DE", &OAuthData{Code: "abc"}); got != nil || err != nil {
+		t.Errorf("default format = %v, %v; want nil, nil", got, err)
+	}
+	if _, err := renderExport("yaml", "MyPeugeot", "DE", &OAuthData{}); err == nil {
+		t.Error("unknown format should fail")
+	}
+	if validExportFormat("yaml") || !validExportFormat(exportFormatStorage) {
+		t.Error("validExportFormat disagrees with renderExport")
+	}
+}
+
+// newTestHAFlowServer stubs Home Assistant's config flow API for the
+// integration: user (mobile_app) -> country (country_code) -> oauth
+// (oauth_code) -> create_entry.
+func newTestHAFlowServer(t *testing.T, submitted map[string]any) *httptest.Server {
+	t.Helper()
+	steps := map[string]string{"": "user", "user": "country", "country": "oauth", "oauth": ""}
+	fields := map[string]string{"user": "mobile_app", "country": "country_code", "oauth": "oauth_code"}
+	var mu sync.Mutex
+	current := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer ha-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var body map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		switch r.URL.Path {
+		case "/api/config/config_entries/flow":
+			if body["handler"] != haDomain {
+				t.Errorf("handler = %v", body["handler"])
+			}
+		case "/api/config/config_entries/flow/flow-1":
+			maps.Copy(submitted, body)
+		default:
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+
+		current = steps[current]
+		if current == "" {
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"type": "create_entry", "flow_id": "flow-1", "result": map[string]string{"entry_id": "entry-1"},
+			})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"type":        "form",
+			"flow_id":     "flow-1",
+			"step_id":     current,
+			"data_schema": []map[string]any{{"name": fields[current], "required": true}},
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestPushToHomeAssistantCreatesEntry(t *testing.T) {
+	submitted := make(map[string]any)
+	srv := newTestHAFlowServer(t, submitted)
+
+	res := pushToHomeAssistant(context.Background(), srv.Client(), &HomeAssistantTarget{URL: srv.URL, Token: "ha-token"},
+		"MyPeugeot", "DE", &OAuthData{Code: "abc"})
+
+	if res.Status != haStatusCreated || res.EntryID != "entry-1" {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	if submitted["mobile_app"] != "MyPeugeot" || submitted["country_code"] != "DE" || submitted["oauth_code"] != "abc" {
+		t.Errorf("submitted = %v", submitted)
+	}
+}
+
+func TestPushToHomeAssistantPendingOnUnknownField(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"type": "form", "flow_id": "flow-1", "step_id": "pin",
+			"data_schema": []map[string]any{{"name": "pin_code", "required": true}},
+		})
+	}))
+	defer srv.Close()
+
+	res := pushToHomeAssistant(context.Background(), srv.Client(), &HomeAssistantTarget{URL: srv.URL}, "MyPeugeot", "DE", &OAuthData{Code: "abc"})
+	if res.Status != haStatusPending || res.StepID != "pin" || res.FlowID != "flow-1" {
+		t.Errorf("unexpected result: %+v", res)
+	}
+}
+
+func TestPushToHomeAssistantUnauthorized(t *testing.T) {
+	srv := newTestHAFlowServer(t, map[string]any{})
+
+	res := pushToHomeAssistant(context.Background(), srv.Client(), &HomeAssistantTarget{URL: srv.URL, Token: "wrong"}, "MyPeugeot", "DE", &OAuthData{Code: "abc"})
+	if res.Status != haStatusFailed || !strings.Contains(res.Error, "401") {
+		t.Errorf("unexpected result: %+v", res)
+	}
+}
+
+func TestPushToHomeAssistantStopsWhenCanceled(t *testing.T) {
+	srv := newTestHAFlowServer(t, map[string]any{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	res := pushToHomeAssistant(ctx, srv.Client(), &HomeAssistantTarget{URL: srv.URL, Token: "ha-token"}, "MyPeugeot", "DE", &OAuthData{Code: "abc"})
+	if res.Status != haStatusFailed || !strings.Contains(res.Error, "context canceled") {
+		t.Errorf("unexpected result: %+v", res)
+	}
+}
+
+func TestPerformOAuthWithExecutorPushesToDefaultTarget(t *testing.T) {
+	submitted := make(map[string]any)
+	srv := newTestHAFlowServer(t, submitted)
+	haDefaultTarget = &HomeAssistantTarget{URL: srv.URL, Token: "ha-token"}
+	defer func() { haDefaultTarget = nil }()
+
+	// The client goes away right after the code is captured; the code is
+	// pushed all the same.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := OAuthRequest{Brand: "MyPeugeot", Country: "DE", Email: "driver@example.com", Password: "secret"}
+	data, err := performOAuthWithExecutor(ctx, req, "request-id", nil, nil, newOAuthMetrics(),
+		stubExecutors(func(oauthAttempt, ProgressFunc, DebugFunc) (authCode, error) {
+			cancel()
+			return authCode{value: "oauth-code", issuedAt: time.Now()}, nil
+		}))
+	if err != nil {
+		t.Fatalf("performOAuthWithExecutor() error = %v", err)
+	}
+	if data.HomeAssistant == nil || data.HomeAssistant.Status != haStatusCreated {
+		t.Fatalf("home_assistant = %+v, want created", data.HomeAssistant)
+	}
+	if submitted["oauth_code"] != "oauth-code" {
+		t.Errorf("submitted = %v", submitted)
+	}
+}
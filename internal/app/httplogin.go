@@ -0,0 +1,275 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// httpLoginTimeout bounds a whole browserless login.
+const httpLoginTimeout = 60 * time.Second
+
+// httpMaxConsentSteps bounds how many consent forms we submit before giving up.
+const httpMaxConsentSteps = 3
+
+// gigyaAccountsURL returns the Gigya accounts API base for a data center.
+var gigyaAccountsURL = func(dataCenter string) string {
+	return "https://accounts." + dataCenter + ".gigya.com"
+}
+
+// gigyaScriptRE finds the Gigya web SDK include on the login page, which names
+// the site's API key and data center (no data center means us1).
+var gigyaScriptRE = regexp.MustCompile(`cdns\.(?:([a-z0-9]+)\.)?gigya\.com/js/gigya\.js\?apiKey=([\w-]+)`)
+
+var (
+	formRE  = regexp.MustCompile(`(?is)<form\b([^>]*)>(.*?)</form>`)
+	fieldRE = regexp.MustCompile(`(?is)<(?:input|button)\b([^>]*)>`)
+	attrRE  = regexp.MustCompile(`([\w-]+)\s*=\s*"([^"]*)"`)
+)
+
+// httpLogin is one browserless login: a cookie jar shared by the ForgeRock
+// and Gigya requests, the attempt being served and the caller's context,
+// which cancels the requests in flight when the client goes away.
+type httpLogin struct {
+	ctx     context.Context
+	client  *http.Client
+	attempt oauthAttempt
+}
+
+// performHTTPOAuth logs in without a browser: it loads the login page
+// ForgeRock redirects to, signs in through Gigya's accounts.login REST API,
+// hands the Gigya session back the way the web SDK does (the glt_<apiKey>
+// cookie), then submits the ForgeRock consent form until the app redirect
+// carries the code. It only works where the login page does not enforce
+// reCAPTCHA, and needs no CloakBrowser session.
+func performHTTPOAuth(ctx context.Context, attempt oauthAttempt, progress ProgressFunc, debug DebugFunc) (authCode, error) {
+	requestID := attempt.requestID
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return authCode{}, err
+	}
+	l := &httpLogin{
+		ctx:     ctx,
+		attempt: attempt,
+		client: &http.Client{
+			Jar:     jar,
+			Timeout: httpLoginTimeout,
+			// Stop at the custom-scheme app redirect instead of following it.
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+					return http.ErrUseLastResponse
+				}
+				if len(via) >= 10 {
+					return fmt.Errorf("stopped after %d redirects", len(via))
+				}
+				return nil
+			},
+		},
+	}
+
+	if progress != nil {
+		progress("Loading login page...")
+	}
+	page, body, code, err := l.fetch(http.MethodGet, attempt.authURL, nil)
+	if err != nil || code != "" {
+		return l.result(code, err)
+	}
+	if debug != nil {
+		debug(fmt.Sprintf("Login page: %s", page))
+	}
+
+	m := gigyaScriptRE.FindStringSubmatch(body)
+	if m == nil {
+		return authCode{}, fmt.Errorf("%w: Gigya SDK not found on %s", errAuthFailed, page.Host)
+	}
+	dataCenter, apiKey := m[1], m[2]
+	if dataCenter == "" {
+		dataCenter = "us1"
+	}
+
+	if progress != nil {
+		progress("Logging in...")
+	}
+	loginToken, err := l.gigyaLogin(gigyaAccountsURL(dataCenter), apiKey)
+	if err != nil {
+		return authCode{}, err
+	}
+	log.Printf("[%s] Gigya login succeeded (data center %s)", requestID, dataCenter)
+
+	// The login page's JS resumes the ForgeRock journey at "goto" once the SDK
+	// has stored the login token; do the same.
+	next := attempt.authURL
+	if gotoURL := page.Query().Get("goto"); gotoURL != "" {
+		if u, err := page.Parse(gotoURL); err == nil {
+			next = u.String()
+		}
+	}
+	authURL, _ := url.Parse(attempt.authURL)
+	glt := &http.Cookie{Name: "glt_" + apiKey, Value: loginToken, Path: "/"}
+	for _, u := range []*url.URL{page, authURL} {
+		jar.SetCookies(u, []*http.Cookie{glt})
+	}
+
+	if progress != nil {
+		progress("Waiting for authorization...")
+	}
+	page, body, code, err = l.fetch(http.MethodGet, next, nil)
+	for step := 0; err == nil && code == "" && step < httpMaxConsentSteps; step++ {
+		action, fields, ok := consentForm(page, body)
+		if !ok {
+			break
+		}
+		if debug != nil {
+			debug(fmt.Sprintf("Submitting consent form: %s", action))
+		}
+		page, body, code, err = l.fetch(http.MethodPost, action, fields)
+	}
+	if err != nil || code != "" {
+		return l.result(code, err)
+	}
+	return authCode{}, errNoRedirect
+}
+
+func (l *httpLogin) result(code string, err error) (authCode, error) {
+	if err != nil {
+		return authCode{}, err
+	}
+	log.Printf("[%s] Captured OAuth code from redirect (http executor)", l.attempt.requestID)
+	return authCode{value: code, issuedAt: time.Now().UTC()}, nil
+}
+
+// fetch performs a request with the login's cookie jar. When the response
+// redirects to the app, the code is returned; otherwise the final page URL
+// and body. Upstream failures wrap errAuthFailed, so they are not reported as
+// our own internal errors.
+func (l *httpLogin) fetch(method, target string, form url.Values) (*url.URL, string, string, error) {
+	var req *http.Request
+	var err error
+	if method == http.MethodPost {
+		req, err = http.NewRequestWithContext(l.ctx, method, target, strings.NewReader(form.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		req, err = http.NewRequestWithContext(l.ctx, method, target, nil)
+	}
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("%w: failed to load %s: %w", errAuthFailed, req.URL.Host, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if location := resp.Header.Get("Location"); strings.HasPrefix(location, l.attempt.scheme+"://") {
+		code, err := redirectCode(location, l.attempt.state)
+		if err != nil {
+			return nil, "", "", err
+		}
+		if code == "" {
+			return nil, "", "", fmt.Errorf("%w: redirect without code", errAuthFailed)
+		}
+		return nil, "", code, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", "", fmt.Errorf("%w: unexpected status %d from %s", errAuthFailed, resp.StatusCode, resp.Request.URL.Host)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 2<<20))
+	if err != nil {
+		return nil, "", "", fmt.Errorf("%w: reading %s: %w", errAuthFailed, resp.Request.URL.Host, err)
+	}
+	return resp.Request.URL, string(body), "", nil
+}
+
+// gigyaLogin signs in with accounts.login and returns the Gigya login token.
+func (l *httpLogin) gigyaLogin(accountsURL, apiKey string) (string, error) {
+	form := url.Values{
+		"apiKey":            {apiKey},
+		"loginID":           {l.attempt.email},
+		"password":          {l.attempt.password},
+		"targetEnv":         {"jssdk"},
+		"sessionExpiration": {"0"},
+	}
+	req, err := http.NewRequestWithContext(l.ctx, http.MethodPost,
+		strings.TrimRight(accountsURL, "/")+"/accounts.login", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%w: gigya login request failed: %w", errAuthFailed, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("%w: reading gigya login response: %w", errAuthFailed, err)
+	}
+	gr, err := parseGigyaResponse(body)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", errAuthFailed, err)
+	}
+	if err := gr.err(); err != nil {
+		return "", err
+	}
+	if gr.SessionInfo.LoginToken == "" {
+		return "", fmt.Errorf("%w: gigya returned no login token", errAuthFailed)
+	}
+	return gr.SessionInfo.LoginToken, nil
+}
+
+// consentForm finds the ForgeRock consent form on page (one with an "allow"
+// decision) and returns its absolute action URL and the fields to submit:
+// its named inputs plus the allow decision, but no other submit buttons.
+func consentForm(page *url.URL, body string) (string, url.Values, bool) {
+	for _, form := range formRE.FindAllStringSubmatch(body, -1) {
+		fields := url.Values{}
+		allow := false
+		for _, field := range fieldRE.FindAllStringSubmatch(form[2], -1) {
+			attrs := htmlAttrs(field[1])
+			name, value := attrs["name"], attrs["value"]
+			if name == "" {
+				continue
+			}
+			isAllow := (name == "decision" && strings.EqualFold(value, "allow")) || name == "allow"
+			if isAllow {
+				allow = true
+				fields.Set(name, value)
+				continue
+			}
+			if t := strings.ToLower(attrs["type"]); t == "submit" || t == "button" || name == "decision" {
+				continue
+			}
+			fields.Add(name, value)
+		}
+		if !allow {
+			continue
+		}
+		action, err := page.Parse(htmlAttrs(form[1])["action"])
+		if err != nil {
+			continue
+		}
+		return action.String(), fields, true
+	}
+	return "", nil, false
+}
+
+// htmlAttrs parses the double-quoted attributes of a tag.
+func htmlAttrs(tag string) map[string]string {
+	attrs := make(map[string]string)
+	for _, m := range attrRE.FindAllStringSubmatch(tag, -1) {
+		attrs[strings.ToLower(m[1])] = html.UnescapeString(m[2])
+	}
+	return attrs
+}
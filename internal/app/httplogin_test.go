@@ -0,0 +1,158 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const testGigyaKey = "3_test-key"
+
+// newTestLoginIdP is a fake ForgeRock + Gigya: the authorize endpoint sends
+// unauthenticated users to a Gigya login page, accepts the glt_ cookie set
+// after accounts.login, and redirects to the app once consent is given.
+func newTestLoginIdP(t *testing.T, password string) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/am/oauth2/authorize", func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("glt_" + testGigyaKey); err != nil || c.Value != "login-token" {
+			http.Redirect(w, r, "/login?goto="+url.QueryEscape(r.URL.String()), http.StatusFound)
+			return
+		}
+		if r.Method == http.MethodPost {
+			_ = r.ParseForm()
+			if r.PostForm.Get("decision") != "allow" || r.PostForm.Get("csrf") != "token-1" {
+				t.Errorf("unexpected consent form: %v", r.PostForm)
+			}
+			target := "mymap://oauth2redirect/de?code=http-code&state=" + url.QueryEscape(r.URL.Query().Get("state"))
+			http.Redirect(w, r, target, http.StatusFound)
+			return
+		}
+		_, _ = fmt.Fprint(w, `<html><body><form method="post" action="`+r.URL.String()+`">
+			<input type="hidden" name="csrf" value="token-1">
+			<button type="submit" name="decision" value="deny">Deny</button>
+			<input type="submit" name="decision" value="allow" id="consentbutton">
+		</form></body></html>`)
+	})
+	mux.HandleFunc("/login", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = fmt.Fprint(w, `<html><head>
+			<script src="https://cdns.eu1.gigya.com/js/gigya.js?apiKey=`+testGigyaKey+`"></script>
+		</head><body><div id="gigya-login-form"></div></body></html>`)
+	})
+	mux.HandleFunc("/accounts.login", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if r.PostForm.Get("apiKey") != testGigyaKey || r.PostForm.Get("loginID") != "driver@example.com" {
+			t.Errorf("unexpected login form: %v", r.PostForm)
+		}
+		if r.PostForm.Get("password") != password {
+			_, _ = fmt.Fprint(w, `{"errorCode":403042,"errorMessage":"Invalid LoginID","errorDetails":"invalid loginID or password"}`)
+			return
+		}
+		_, _ = fmt.Fprint(w, `{"errorCode":0,"sessionInfo":{"login_token":"login-token"}}`)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	orig := gigyaAccountsURL
+	gigyaAccountsURL = func(dataCenter string) string {
+		if dataCenter != "eu1" {
+			t.Errorf("data center = %q, want eu1", dataCenter)
+		}
+		return srv.URL
+	}
+	t.Cleanup(func() { gigyaAccountsURL = orig })
+	return srv
+}
+
+func testHTTPAttempt(srv *httptest.Server, password string) oauthAttempt {
+	return oauthAttempt{
+		authURL:   srv.URL + "/am/oauth2/authorize?client_id=client-id&state=state-1",
+		email:     "driver@example.com",
+		password:  password,
+		scheme:    "mymap",
+		state:     "state-1",
+		requestID: "request-id",
+	}
+}
+
+func TestPerformHTTPOAuth(t *testing.T) {
+	srv := newTestLoginIdP(t, "secret")
+
+	code, err := performHTTPOAuth(context.Background(), testHTTPAttempt(srv, "secret"), nil, nil)
+	if err != nil {
+		t.Fatalf("performHTTPOAuth() error = %v", err)
+	}
+	if code.value != "http-code" || code.issuedAt.IsZero() {
+		t.Errorf("code = %+v, want http-code with capture time", code)
+	}
+}
+
+func TestPerformHTTPOAuthWrongPassword(t *testing.T) {
+	srv := newTestLoginIdP(t, "secret")
+
+	_, err := performHTTPOAuth(context.Background(), testHTTPAttempt(srv, "wrong"), nil, nil)
+	if !errors.Is(err, errAuthFailed) || !strings.Contains(err.Error(), "invalid loginID or password") {
+		t.Fatalf("performHTTPOAuth() error = %v, want Gigya login failure", err)
+	}
+}
+
+func TestPerformHTTPOAuthReportsUpstreamFailuresAsAuthFailed(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+	}))
+	defer down.Close()
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+
+	for name, srv := range map[string]*httptest.Server{"error status": down, "unreachable": gone} {
+		_, err := performHTTPOAuth(context.Background(), testHTTPAttempt(srv, "secret"), nil, nil)
+		if got := errorCodeOf(err); got != codeAuthFailed {
+			t.Errorf("%s: error code = %q (%v), want %q", name, got, err, codeAuthFailed)
+		}
+	}
+}
+
+func TestPerformHTTPOAuthRejectsForeignState(t *testing.T) {
+	srv := newTestLoginIdP(t, "secret")
+	attempt := testHTTPAttempt(srv, "secret")
+	attempt.state = "other-state"
+
+	if _, err := performHTTPOAuth(context.Background(), attempt, nil, nil); err == nil || !strings.Contains(err.Error(), "state mismatch") {
+		t.Fatalf("performHTTPOAuth() error = %v, want state mismatch", err)
+	}
+}
+
+func TestConsentFormSkipsOtherButtons(t *testing.T) {
+	page, _ := url.Parse("https://idp.example/am/oauth2/authorize?x=1")
+	body := `<form action="/am/oauth2/authorize?x=1&amp;y=2">
+		<input name="csrf" value="c">
+		<button name="decision" value="deny">No</button>
+		<button name="decision" value="allow">Yes</button>
+	</form>`
+
+	action, fields, ok := consentForm(page, body)
+	if !ok {
+		t.Fatal("consentForm() found no form")
+	}
+	if action != "https://idp.example/am/oauth2/authorize?x=1&y=2" {
+		t.Errorf("action = %q", action)
+	}
+	if fields.Encode() != "csrf=c&decision=allow" {
+		t.Errorf("fields = %q", fields.Encode())
+	}
+}
+
+func TestPerformHTTPOAuthStopsWhenCanceled(t *testing.T) {
+	srv := newTestLoginIdP(t, "secret")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := performHTTPOAuth(ctx, testHTTPAttempt(srv, "secret"), nil, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("performHTTPOAuth() error = %v, want context canceled", err)
+	}
+}
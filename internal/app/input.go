@@ -0,0 +1,122 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// maxInputLength bounds a one-time code submitted to /oauth/{requestID}/input.
+const maxInputLength = 64
+
+var (
+	// errNoInteractiveInput means the login needs a one-time code but the
+	// request cannot be asked for one (it is not streaming over SSE).
+	errNoInteractiveInput = fmt.Errorf("%w: a verification code is required; retry with the web UI or the SSE API", errAuthFailed)
+	errNoPendingInput     = errors.New("no verification code was requested for this request")
+)
+
+// inputs connects logins waiting for a one-time code with the SSE streams
+// that can prompt for it and POST /oauth/{requestID}/input, which answers.
+var inputs = newInputBroker()
+
+type inputBroker struct {
+	mu       sync.Mutex
+	sessions map[string]*inputSession
+}
+
+type inputSession struct {
+	notify  func(prompt string) // emits the input_required event
+	answers chan string
+	pending bool
+}
+
+func newInputBroker() *inputBroker {
+	return &inputBroker{sessions: make(map[string]*inputSession)}
+}
+
+// open registers requestID as able to prompt through notify, until the
+// returned func is called.
+func (b *inputBroker) open(requestID string, notify func(prompt string)) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sessions[requestID] = &inputSession{notify: notify, answers: make(chan string, 1)}
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.sessions, requestID)
+	}
+}
+
+// request prompts the user of requestID and waits for their answer or ctx.
+func (b *inputBroker) request(ctx context.Context, requestID, prompt string) (string, error) {
+	b.mu.Lock()
+	s, ok := b.sessions[requestID]
+	if ok {
+		s.pending = true
+	}
+	b.mu.Unlock()
+	if !ok {
+		return "", errNoInteractiveInput
+	}
+
+	log.Printf("[%s] Waiting for user input: %s", requestID, prompt)
+	s.notify(prompt)
+	select {
+	case answer := <-s.answers:
+		return answer, nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		s.pending = false
+		b.mu.Unlock()
+		return "", ctx.Err()
+	}
+}
+
+// submit hands value to the login of requestID waiting for it.
+func (b *inputBroker) submit(requestID, value string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, ok := b.sessions[requestID]
+	if !ok || !s.pending {
+		return errNoPendingInput
+	}
+	s.pending = false
+	s.answers <- value
+	return nil
+}
+
+// InputRequest is the body of POST /oauth/{requestID}/input.
+type InputRequest struct {
+	Code string `json:"code"`
+}
+
+func handleOAuthInput(w http.ResponseWriter, r *http.Request) {
+	requestID := r.PathValue("requestID")
+
+	var req InputRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, codeInvalidRequest, "Invalid request body")
+		return
+	}
+	if req.Code == "" || len(req.Code) > maxInputLength {
+		sendError(w, codeInvalidRequest, "code is required")
+		return
+	}
+
+	if err := inputs.submit(requestID, req.Code); err != nil {
+		sendError(w, codeNotFound, err.Error())
+		return
+	}
+	log.Printf("[%s] Received user input", requestID)
+	sendSuccess(w, nil, nil)
+}
+
+// inputURL is where the answer to an input_required event is POSTed.
+func inputURL(requestID string) string {
+	return "/oauth/" + requestID + "/input"
+}
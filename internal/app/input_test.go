@@ -0,0 +1,84 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInputBrokerRoundTrip(t *testing.T) {
+	broker := newInputBroker()
+	prompts := make(chan string, 1)
+	defer broker.open("req", func(prompt string) { prompts <- prompt })()
+
+	go func() {
+		<-prompts
+		if err := broker.submit("req", "123456"); err != nil {
+			t.Errorf("submit() error = %v", err)
+		}
+	}()
+
+	answer, err := broker.request(context.Background(), "req", "Enter the code")
+	if err != nil || answer != "123456" {
+		t.Fatalf("request() = %q, %v; want 123456", answer, err)
+	}
+	if err := broker.submit("req", "654321"); !errors.Is(err, errNoPendingInput) {
+		t.Errorf("second submit() error = %v, want errNoPendingInput", err)
+	}
+}
+
+func TestInputBrokerWithoutStream(t *testing.T) {
+	_, err := newInputBroker().request(context.Background(), "req", "Enter the code")
+	if !errors.Is(err, errAuthFailed) {
+		t.Fatalf("request() error = %v, want errAuthFailed", err)
+	}
+}
+
+func TestInputBrokerTimeout(t *testing.T) {
+	broker := newInputBroker()
+	defer broker.open("req", func(string) {})()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := broker.request(ctx, "req", "Enter the code"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("request() error = %v, want deadline exceeded", err)
+	}
+	if err := broker.submit("req", "123456"); !errors.Is(err, errNoPendingInput) {
+		t.Errorf("submit() after timeout error = %v, want errNoPendingInput", err)
+	}
+}
+
+func TestHandleOAuthInput(t *testing.T) {
+	broker := setGlobal(t, &inputs, newInputBroker())
+	prompted := make(chan struct{})
+	defer broker.open("req", func(string) { close(prompted) })()
+	answers := make(chan string, 1)
+	go func() {
+		answer, _ := broker.request(context.Background(), "req", "Enter the code")
+		answers <- answer
+	}()
+	<-prompted
+	mux := newApplicationMux()
+
+	post := func(id, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, inputURL(id), strings.NewReader(body)))
+		return w
+	}
+	if w := post("req", `{"code":""}`); w.Code != http.StatusBadRequest {
+		t.Errorf("empty code: status = %d, want 400", w.Code)
+	}
+	if w := post("other", `{"code":"123456"}`); w.Code != http.StatusNotFound {
+		t.Errorf("unknown request: status = %d, want 404", w.Code)
+	}
+	if w := post("req", `{"code":"123456"}`); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	if answer := <-answers; answer != "123456" {
+		t.Errorf("answer = %q, want 123456", answer)
+	}
+}
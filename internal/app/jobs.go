@@ -0,0 +1,293 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// defaultJobTTL is how long a finished job waits for its result to be read.
+const defaultJobTTL = 5 * time.Minute
+
+// jobTimeout bounds a job's login, queueing and session retries included
+// (set up in Run).
+var jobTimeout = 10 * time.Minute
+
+// jobs holds the logins started through POST /api/jobs (set up in Run).
+var jobs = newJobStore(defaultJobTTL)
+
+// Job states reported by GET /api/jobs/{id}.
+const (
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+// JobStatus is the response of the job endpoints. Data and Export are set
+// once the job succeeded, ErrorCode once it failed; Message is the latest
+// progress step or the error.
+type JobStatus struct {
+	ID        string     `json:"id"`
+	Status    string     `json:"status"`
+	Message   string     `json:"message,omitempty"`
+	ErrorCode errorCode  `json:"error_code,omitempty"`
+	Data      *OAuthData `json:"data,omitempty"`
+	Export    any        `json:"export,omitempty"`
+	EventsURL string     `json:"events_url"`
+}
+
+// jobStore keeps jobs in memory only, keyed by job ID (which doubles as the
+// request ID). A finished job is removed once its result has been read, or
+// ttl after it finished, whichever comes first; the TTL is enforced by a
+// timer, so results do not linger while no requests come in.
+type jobStore struct {
+	mu   sync.Mutex
+	ttl  time.Duration
+	jobs map[string]*job
+}
+
+// job is one asynchronous login. Its events are kept in order and numbered
+// from 1, so a client that reconnects to the event stream resumes after the
+// last one it saw.
+type job struct {
+	id     string
+	cancel context.CancelFunc // ends the login's context
+
+	mu       sync.Mutex
+	events   []jobEvent
+	wake     chan struct{} // closed and replaced whenever the job changes
+	state    string
+	message  string
+	code     errorCode
+	data     *OAuthData
+	export   any
+	finished time.Time
+}
+
+type jobEvent struct {
+	eventType string
+	payload   []byte
+}
+
+func newJobStore(ttl time.Duration) *jobStore {
+	return &jobStore{ttl: ttl, jobs: make(map[string]*job)}
+}
+
+// start registers a job under id and runs login in the background, with a
+// context that ends after jobTimeout or when the job is cancelled, and the
+// job's emit for its events.
+func (s *jobStore) start(
+	id string,
+	login func(ctx context.Context, emit func(eventType string, payload []byte)) (*OAuthData, any, error),
+) *job {
+	ctx, cancel := context.WithTimeout(context.Background(), jobTimeout)
+	j := s.create(id, cancel)
+	go func() {
+		defer cancel()
+		data, export, err := login(ctx, j.emit)
+		j.finish(data, export, err)
+		time.AfterFunc(s.ttl, func() { s.remove(j.id) })
+	}()
+	return j
+}
+
+// create registers a running job under id and drops expired ones.
+func (s *jobStore) create(id string, cancel context.CancelFunc) *job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for jobID, j := range s.jobs {
+		if j.expired(now, s.ttl) {
+			delete(s.jobs, jobID)
+		}
+	}
+	j := &job{id: id, cancel: cancel, state: jobRunning, wake: make(chan struct{})}
+	s.jobs[id] = j
+	return j
+}
+
+func (s *jobStore) get(id string) (*job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if ok && j.expired(time.Now(), s.ttl) {
+		delete(s.jobs, id)
+		return nil, false
+	}
+	return j, ok
+}
+
+func (s *jobStore) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.jobs, id)
+}
+
+func (j *job) expired(now time.Time, ttl time.Duration) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.state != jobRunning && now.After(j.finished.Add(ttl))
+}
+
+// emit buffers an event of the login; it is streamOAuth's emit.
+func (j *job) emit(eventType string, payload []byte) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.events = append(j.events, jobEvent{eventType: eventType, payload: payload})
+	if eventType == eventProgress {
+		var ev struct{ Message string }
+		if json.Unmarshal(payload, &ev) == nil {
+			j.message = ev.Message
+		}
+	}
+	j.notify()
+}
+
+// finish records the outcome of the login.
+func (j *job) finish(data *OAuthData, export any, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.finished = time.Now()
+	if err != nil {
+		j.state, j.message, j.code = jobFailed, err.Error(), errorCodeOf(err)
+	} else {
+		j.state, j.message, j.data, j.export = jobSucceeded, "", data, export
+	}
+	j.notify()
+}
+
+// notify wakes the event streams waiting for the job. The caller holds j.mu.
+func (j *job) notify() {
+	close(j.wake)
+	j.wake = make(chan struct{})
+}
+
+// since returns the events after lastID along with the ID they follow (lastID
+// clamped to the events there are), whether the job has finished and a
+// channel that is closed on the next change.
+func (j *job) since(lastID int) ([]jobEvent, int, bool, <-chan struct{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	lastID = min(max(lastID, 0), len(j.events))
+	return j.events[lastID:], lastID, j.state != jobRunning, j.wake
+}
+
+func (j *job) status() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return JobStatus{
+		ID:        j.id,
+		Status:    j.state,
+		Message:   j.message,
+		ErrorCode: j.code,
+		Data:      j.data,
+		Export:    j.export,
+		EventsURL: jobEventsURL(j.id),
+	}
+}
+
+func jobURL(id string) string {
+	return "/api/jobs/" + id
+}
+
+func jobEventsURL(id string) string {
+	return jobURL(id) + "/events"
+}
+
+// handleCreateJob starts a login in the background and returns its job ID
+// right away. The login does not depend on any connection staying open.
+func handleCreateJob(w http.ResponseWriter, r *http.Request) {
+	priority, ok := requestPriority(w, r)
+	if !ok {
+		return
+	}
+	req, format, clientIP, ok := parseOAuthRequest(w, r)
+	if !ok {
+		return
+	}
+
+	id := uuid.New().String()
+	log.Printf("[%s] OAuth job from %s for user %s (%s/%s)", id, clientIP, req.Email, req.Brand, req.Country)
+	j := jobs.start(id, func(ctx context.Context, emit func(string, []byte)) (*OAuthData, any, error) {
+		return streamOAuth(withGateClient(ctx, clientIP, priority), req, id, clientIP, format, emit)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", jobURL(j.id))
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(j.status())
+}
+
+// handleJobStatus reports a job. Its result is returned only once: a
+// finished job is forgotten after this read.
+func handleJobStatus(w http.ResponseWriter, r *http.Request) {
+	j, ok := jobs.get(r.PathValue("id"))
+	if !ok {
+		sendError(w, codeNotFound, "job not found or already retrieved")
+		return
+	}
+	status := j.status()
+	if status.Status != jobRunning {
+		jobs.remove(j.id)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+// handleCancelJob stops a running job; it then fails with client_aborted.
+// Cancelling a finished job changes nothing.
+func handleCancelJob(w http.ResponseWriter, r *http.Request) {
+	j, ok := jobs.get(r.PathValue("id"))
+	if !ok {
+		sendError(w, codeNotFound, "job not found or already retrieved")
+		return
+	}
+	log.Printf("[%s] OAuth job cancelled", j.id)
+	j.cancel()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(j.status())
+}
+
+// handleJobEvents streams a job's events as SSE, replaying the buffered ones
+// after Last-Event-ID first. The stream ends after the success or error
+// event, which counts as reading the result.
+func handleJobEvents(w http.ResponseWriter, r *http.Request) {
+	j, ok := jobs.get(r.PathValue("id"))
+	if !ok {
+		sendError(w, codeNotFound, "job not found or already retrieved")
+		return
+	}
+	lastID, _ := strconv.Atoi(strings.TrimSpace(r.Header.Get("Last-Event-ID")))
+	stream, ok := startSSE(w)
+	if !ok {
+		return
+	}
+	defer stream.keepAlive(r.Context())()
+
+	for {
+		events, after, done, wake := j.since(lastID)
+		stream.resumeAfter(after)
+		for _, ev := range events {
+			stream.emit(ev.eventType, ev.payload)
+		}
+		lastID = after + len(events)
+		if done {
+			jobs.remove(j.id)
+			return
+		}
+		select {
+		case <-wake:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
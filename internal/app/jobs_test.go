@@ -0,0 +1,177 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createTestJob posts a login to /api/jobs and returns the job's status.
+func createTestJob(t *testing.T, mux http.Handler) JobStatus {
+	t.Helper()
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/jobs", strings.NewReader(
+		`{"brand":"MyPeugeot","country":"DE","email":"driver@example.com","password":"secret"}`)))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("create status = %d, want 202: %s", w.Code, w.Body.String())
+	}
+	var status JobStatus
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatalf("decode job: %v", err)
+	}
+	if status.ID == "" || status.Status != jobRunning || w.Header().Get("Location") != jobURL(status.ID) {
+		t.Fatalf("job = %+v, Location %q", status, w.Header().Get("Location"))
+	}
+	return status
+}
+
+func TestJobStatusIsDeletedAfterRead(t *testing.T) {
+	release := make(chan struct{})
+	setGlobal(t, &jobs, newJobStore(time.Minute))
+	setGlobal(t, &executors, stubExecutors(func(_ oauthAttempt, progress ProgressFunc, _ DebugFunc) (authCode, error) {
+		progress("Logging in...")
+		<-release
+		return authCode{value: "job-code", issuedAt: time.Now()}, nil
+	}))
+	mux := newApplicationMux()
+	job := createTestJob(t, mux)
+
+	get := func() (int, JobStatus) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, jobURL(job.ID), nil))
+		var status JobStatus
+		_ = json.NewDecoder(w.Body).Decode(&status)
+		return w.Code, status
+	}
+	if code, status := get(); code != http.StatusOK || status.Status != jobRunning {
+		t.Fatalf("running job: %d %+v", code, status)
+	}
+
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	var status JobStatus
+	for status.Status != jobSucceeded && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		_, status = get()
+	}
+	if status.Data == nil || status.Data.Code != "job-code" {
+		t.Fatalf("finished job = %+v, want the code", status)
+	}
+	if code, _ := get(); code != http.StatusNotFound {
+		t.Errorf("second read: status = %d, want 404", code)
+	}
+}
+
+func TestJobEventsResumeAfterLastEventID(t *testing.T) {
+	setGlobal(t, &jobs, newJobStore(time.Minute))
+	setGlobal(t, &executors, stubExecutors(func(_ oauthAttempt, progress ProgressFunc, _ DebugFunc) (authCode, error) {
+		progress("Loading login page...")
+		progress("Logging in...")
+		return authCode{value: "job-code", issuedAt: time.Now()}, nil
+	}))
+	mux := newApplicationMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	job := createTestJob(t, mux)
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+job.EventsURL, nil)
+	req.Header.Set("Last-Event-ID", "2")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("events: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var ids, types []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if id, ok := strings.CutPrefix(line, "id: "); ok {
+			ids = append(ids, id)
+		}
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			var ev struct{ Type string }
+			_ = json.Unmarshal([]byte(data), &ev)
+			types = append(types, ev.Type)
+		}
+	}
+	// Events 1 and 2 are "Preparing authentication..." and "Loading login
+	// page..."; the stream resumes after them and ends with the result.
+	if len(types) == 0 || types[len(types)-1] != eventSuccess || ids[0] != "3" {
+		t.Fatalf("events after 2: ids %v, types %v", ids, types)
+	}
+	if _, ok := jobs.get(job.ID); ok {
+		t.Error("job kept after its result was streamed")
+	}
+}
+
+func TestJobStoreExpiresFinishedJobs(t *testing.T) {
+	store := newJobStore(time.Millisecond)
+	running := store.create("running", func() {})
+	finished := store.create("finished", func() {})
+	finished.finish(nil, nil, errAuthFailed)
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok := store.get("finished"); ok {
+		t.Error("finished job outlived its TTL")
+	}
+	if j, ok := store.get("running"); !ok || j != running {
+		t.Error("running job expired")
+	}
+}
+
+func TestJobStoreRemovesFinishedJobsWithoutTraffic(t *testing.T) {
+	store := newJobStore(time.Millisecond)
+	store.start("job", func(context.Context, func(string, []byte)) (*OAuthData, any, error) {
+		return &OAuthData{Code: "job-code"}, nil, nil
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		store.mu.Lock()
+		n := len(store.jobs)
+		store.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("finished job kept past its TTL without any further requests")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	release := make(chan struct{})
+	setGlobal(t, &jobs, newJobStore(time.Minute))
+	setGlobal(t, &executors, stubExecutors(func(oauthAttempt, ProgressFunc, DebugFunc) (authCode, error) {
+		<-release
+		return authCode{}, errors.New("browser closed")
+	}))
+	mux := newApplicationMux()
+	job := createTestJob(t, mux)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, jobURL(job.ID), nil))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("cancel status = %d, want 202: %s", w.Code, w.Body.String())
+	}
+	close(release)
+
+	j, _ := jobs.get(job.ID)
+	deadline := time.Now().Add(5 * time.Second)
+	status := j.status()
+	for status.Status == jobRunning && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		status = j.status()
+	}
+	if status.Status != jobFailed || status.ErrorCode != codeClientAborted {
+		t.Errorf("cancelled job = %+v, want failed with %q", status, codeClientAborted)
+	}
+}
@@ -0,0 +1,265 @@
+package app
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwksPath is the ForgeRock AM JWKS endpoint, relative to a brand's oauth_url.
+const jwksPath = "/am/oauth2/connect/jwk_uri"
+
+// idTokenLeeway tolerates small clock skew between us and ForgeRock when
+// checking the id_token expiry.
+const idTokenLeeway = time.Minute
+
+// errSigningKeysUnavailable means the id_token could not be checked because
+// the JWKS could not be fetched, as opposed to failing the check.
+var errSigningKeysUnavailable = errors.New("signing keys unavailable")
+
+// idTokenKeys caches each brand's signing keys (see jwksCache).
+var idTokenKeys = newJWKSCache(&http.Client{Timeout: 10 * time.Second}, time.Hour)
+
+// IDTokenClaims are the verified id_token claims surfaced to the caller so
+// they can check which account they logged into before using the result.
+type IDTokenClaims struct {
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// jwksCache holds the RSA signing keys per JWKS URL for ttl. An unknown key ID
+// forces a refetch so a ForgeRock key rotation is picked up immediately.
+type jwksCache struct {
+	mu      sync.Mutex
+	client  *http.Client
+	ttl     time.Duration
+	entries map[string]jwksEntry
+}
+
+type jwksEntry struct {
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+func newJWKSCache(client *http.Client, ttl time.Duration) *jwksCache {
+	return &jwksCache{
+		client:  client,
+		ttl:     ttl,
+		entries: make(map[string]jwksEntry),
+	}
+}
+
+// key returns the public key with key ID kid published at jwksURL. The JWKS
+// is fetched without holding c.mu, so a slow endpoint only delays the
+// verifications that need it.
+func (c *jwksCache) key(jwksURL, kid string) (*rsa.PublicKey, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[jwksURL]
+	c.mu.Unlock()
+	if ok && time.Since(entry.fetched) < c.ttl {
+		if k, found := entry.keys[kid]; found {
+			return k, nil
+		}
+	}
+
+	keys, err := c.fetch(jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.entries[jwksURL] = jwksEntry{keys: keys, fetched: time.Now()}
+	c.mu.Unlock()
+	k, found := keys[kid]
+	if !found {
+		return nil, fmt.Errorf("no signing key %q in %s", kid, jwksURL)
+	}
+	return k, nil
+}
+
+// fetch downloads and parses a JWKS document, keeping only RSA keys.
+func (c *jwksCache) fetch(jwksURL string) (map[string]*rsa.PublicKey, error) {
+	resp, err := c.client.Get(jwksURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: fetching JWKS %s: %w", errSigningKeysUnavailable, jwksURL, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: JWKS %s returned status %d", errSigningKeysUnavailable, jwksURL, resp.StatusCode)
+	}
+
+	var doc struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("%w: parsing JWKS %s: %w", errSigningKeysUnavailable, jwksURL, err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range doc.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) == 0 {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
+
+// verifyTokens checks data's id_token (if any) and attaches its claims. nonce
+// is only compared when non-empty: a code pasted into /token or a refreshed
+// token has no nonce we could know about.
+//
+// ForgeRock has issued the tokens by now and the code is spent, so only a
+// failed check is an error. When the signing keys cannot be fetched the
+// tokens are returned flagged as IDTokenUnverified instead of being lost.
+func verifyTokens(keys *jwksCache, data *OAuthData, brand BrandConfig, country CountryConfig, nonce string) error {
+	if data.IDToken == "" {
+		return nil
+	}
+	claims, err := verifyIDToken(keys, data.IDToken, brand, country.ClientID, nonce, time.Now())
+	if errors.Is(err, errSigningKeysUnavailable) {
+		log.Printf("Returning unverified id_token: %v", err)
+		data.IDTokenUnverified = true
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("id_token verification failed: %w", err)
+	}
+	data.Claims = claims
+	return nil
+}
+
+// verifyIDToken validates an RS256/384/512-signed id_token against the brand's
+// JWKS and checks iss, aud, exp and (optionally) nonce.
+func verifyIDToken(
+	keys *jwksCache, raw string, brand BrandConfig, clientID, nonce string, now time.Time,
+) (*IDTokenClaims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("decoding header: %w", err)
+	}
+	hash, ok := map[string]crypto.Hash{
+		"RS256": crypto.SHA256,
+		"RS384": crypto.SHA384,
+		"RS512": crypto.SHA512,
+	}[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", header.Alg)
+	}
+
+	base := strings.TrimRight(brand.OAuthURL, "/")
+	key, err := keys.key(base+jwksPath, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("decoding signature: %w", err)
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), sig); err != nil {
+		return nil, errors.New("invalid signature")
+	}
+
+	var claims struct {
+		Iss   string   `json:"iss"`
+		Sub   string   `json:"sub"`
+		Aud   audience `json:"aud"`
+		Exp   int64    `json:"exp"`
+		Nonce string   `json:"nonce"`
+		Email string   `json:"email"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("decoding claims: %w", err)
+	}
+	if want := base + "/am/oauth2"; normalizeIssuer(claims.Iss) != normalizeIssuer(want) {
+		return nil, fmt.Errorf("issuer %q, want %q", claims.Iss, want)
+	}
+	if !slices.Contains(claims.Aud, clientID) {
+		return nil, fmt.Errorf("audience %v does not include client %s", []string(claims.Aud), clientID)
+	}
+	expiresAt := time.Unix(claims.Exp, 0).UTC()
+	if now.After(expiresAt.Add(idTokenLeeway)) {
+		return nil, fmt.Errorf("token expired at %s", expiresAt.Format(time.RFC3339))
+	}
+	if nonce != "" && claims.Nonce != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+
+	return &IDTokenClaims{
+		Subject:   claims.Sub,
+		Email:     claims.Email,
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+// audience accepts the JWT "aud" claim as either a string or an array.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// normalizeIssuer drops a default https port and trailing slash: ForgeRock
+// may advertise its issuer as https://host:443/am/oauth2.
+func normalizeIssuer(iss string) string {
+	u, err := url.Parse(iss)
+	if err != nil {
+		return iss
+	}
+	if u.Scheme == "https" && u.Port() == "443" {
+		u.Host = u.Hostname()
+	}
+	return strings.TrimRight(u.String(), "/")
+}
@@ -0,0 +1,222 @@
+package app
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testKID = "test-key"
+
+var (
+	testKeyOnce sync.Once
+	testKey     *rsa.PrivateKey
+)
+
+// testSigningKey returns an RSA key shared by all tests (generation is slow).
+func testSigningKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	testKeyOnce.Do(func() {
+		k, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatalf("generate key: %v", err)
+		}
+		testKey = k
+	})
+	return testKey
+}
+
+// testJWKS renders the public half of key as a JWKS document.
+func testJWKS(key *rsa.PrivateKey) []byte {
+	doc, _ := json.Marshal(map[string]any{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": testKID,
+		"use": "sig",
+		"alg": "RS256",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}})
+	return doc
+}
+
+// signTestIDToken returns an RS256 JWT over claims, signed with key.
+func signTestIDToken(t *testing.T, key *rsa.PrivateKey, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": testKID, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// newTestJWKSServer serves the JWKS for key and counts the fetches.
+func newTestJWKSServer(t *testing.T, key *rsa.PrivateKey) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != jwksPath {
+			http.NotFound(w, r)
+			return
+		}
+		fetches.Add(1)
+		_, _ = w.Write(testJWKS(key))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &fetches
+}
+
+func validTestClaims(issuerBase string) map[string]any {
+	return map[string]any{
+		"iss":   issuerBase + "/am/oauth2",
+		"sub":   "user-1",
+		"aud":   "client-id",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": "n-1",
+		"email": "driver@example.com",
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	key := testSigningKey(t)
+	srv, _ := newTestJWKSServer(t, key)
+	brand := BrandConfig{OAuthURL: srv.URL}
+
+	cases := []struct {
+		name    string
+		mutate  func(map[string]any)
+		nonce   string
+		wantErr string
+	}{
+		{name: "valid", nonce: "n-1"},
+		{name: "nonce not checked when unknown", mutate: func(c map[string]any) { delete(c, "nonce") }},
+		{name: "audience array", mutate: func(c map[string]any) { c["aud"] = []string{"other", "client-id"} }},
+		{name: "wrong audience", mutate: func(c map[string]any) { c["aud"] = "other" }, wantErr: "audience"},
+		{name: "wrong issuer", mutate: func(c map[string]any) { c["iss"] = "https://evil.example/am/oauth2" }, wantErr: "issuer"},
+		{name: "wrong nonce", nonce: "n-2", wantErr: "nonce"},
+		{
+			name:    "expired",
+			mutate:  func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+			wantErr: "expired",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			claims := validTestClaims(srv.URL)
+			if tc.mutate != nil {
+				tc.mutate(claims)
+			}
+			raw := signTestIDToken(t, key, claims)
+
+			got, err := verifyIDToken(newJWKSCache(srv.Client(), time.Hour), raw, brand, "client-id", tc.nonce, time.Now())
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("verifyIDToken() error = %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verifyIDToken() error = %v", err)
+			}
+			if got.Subject != "user-1" || got.Email != "driver@example.com" || got.ExpiresAt.IsZero() {
+				t.Errorf("unexpected claims: %+v", got)
+			}
+		})
+	}
+}
+
+func TestVerifyIDTokenRejectsForgedSignature(t *testing.T) {
+	key := testSigningKey(t)
+	srv, _ := newTestJWKSServer(t, key)
+
+	raw := signTestIDToken(t, key, validTestClaims(srv.URL))
+	parts := strings.Split(raw, ".")
+	forged, _ := json.Marshal(map[string]any{"iss": srv.URL + "/am/oauth2", "sub": "someone-else", "aud": "client-id"})
+	raw = parts[0] + "." + base64.RawURLEncoding.EncodeToString(forged) + "." + parts[2]
+
+	_, err := verifyIDToken(newJWKSCache(srv.Client(), time.Hour), raw, BrandConfig{OAuthURL: srv.URL}, "client-id", "", time.Now())
+	if err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Fatalf("verifyIDToken() error = %v, want invalid signature", err)
+	}
+}
+
+func TestJWKSCacheHonoursTTL(t *testing.T) {
+	key := testSigningKey(t)
+	srv, fetches := newTestJWKSServer(t, key)
+	jwksURL := srv.URL + jwksPath
+
+	cache := newJWKSCache(srv.Client(), time.Hour)
+	for range 3 {
+		if _, err := cache.key(jwksURL, testKID); err != nil {
+			t.Fatalf("key() error = %v", err)
+		}
+	}
+	if got := fetches.Load(); got != 1 {
+		t.Errorf("fetches with warm cache = %d, want 1", got)
+	}
+
+	// An unknown kid forces a refetch (key rotation).
+	if _, err := cache.key(jwksURL, "rotated"); err == nil {
+		t.Error("key() for unknown kid should fail")
+	}
+	if got := fetches.Load(); got != 2 {
+		t.Errorf("fetches after unknown kid = %d, want 2", got)
+	}
+
+	expired := newJWKSCache(srv.Client(), 0)
+	_, _ = expired.key(jwksURL, testKID)
+	_, _ = expired.key(jwksURL, testKID)
+	if got := fetches.Load(); got != 4 {
+		t.Errorf("fetches with zero TTL = %d, want 4", got)
+	}
+}
+
+func TestJWKSCacheFetchesWithoutBlockingOtherURLs(t *testing.T) {
+	key := testSigningKey(t)
+	fast, _ := newTestJWKSServer(t, key)
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		_, _ = w.Write(testJWKS(key))
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	cache := newJWKSCache(http.DefaultClient, time.Hour)
+	go func() { _, _ = cache.key(slow.URL+jwksPath, testKID) }()
+	time.Sleep(20 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := cache.key(fast.URL+jwksPath, testKID)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("key() error = %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("key() waited for another URL's fetch")
+	}
+}
+
+func TestNormalizeIssuer(t *testing.T) {
+	if normalizeIssuer("https://idpcvs.peugeot.com:443/am/oauth2") != normalizeIssuer("https://idpcvs.peugeot.com/am/oauth2/") {
+		t.Error("default https port and trailing slash should not matter")
+	}
+}
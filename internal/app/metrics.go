@@ -1,7 +1,9 @@
 package app
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -11,8 +13,14 @@ import (
 type oauthMetrics struct {
 	success *prometheus.CounterVec
 	failure *prometheus.CounterVec
-	allowed map[string]struct{}
-	gather  prometheus.Gatherer
+	// aborted counts logins whose client disconnected before they finished;
+	// they are neither a success nor the login's fault.
+	aborted *prometheus.CounterVec
+	// executorAttempts counts every executor run, so a request that fell back
+	// from one executor to another is seen by both.
+	executorAttempts *prometheus.CounterVec
+	allowed          map[string]struct{}
+	gather           prometheus.Gatherer
 }
 
 func newOAuthMetrics() *oauthMetrics {
@@ -26,14 +34,26 @@ func newOAuthMetrics() *oauthMetrics {
 		Name:      "oauth_failure_total",
 		Help:      "Total number of failed Stellantis OAuth attempts.",
 	}, []string{"brand", countryKey})
+	aborted := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "stelloauth",
+		Name:      "oauth_aborted_total",
+		Help:      "Total number of Stellantis OAuth attempts abandoned by a client disconnect.",
+	}, []string{"brand", countryKey})
+	executorAttempts := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "stelloauth",
+		Name:      "executor_attempts_total",
+		Help:      "Total number of login attempts per executor and outcome.",
+	}, []string{"executor", "brand", countryKey, "outcome"})
 	registry := prometheus.NewRegistry()
-	registry.MustRegister(success, failure)
+	registry.MustRegister(success, failure, aborted, executorAttempts)
 
 	return &oauthMetrics{
-		success: success,
-		failure: failure,
-		allowed: make(map[string]struct{}),
-		gather:  registry,
+		success:          success,
+		failure:          failure,
+		aborted:          aborted,
+		executorAttempts: executorAttempts,
+		allowed:          make(map[string]struct{}),
+		gather:           registry,
 	}
 }
 
@@ -48,6 +68,7 @@ func (m *oauthMetrics) initialize(data []byte) error {
 			m.allowed[metricTarget(brand, country)] = struct{}{}
 			m.success.WithLabelValues(brand, country).Add(0)
 			m.failure.WithLabelValues(brand, country).Add(0)
+			m.aborted.WithLabelValues(brand, country).Add(0)
 		}
 	}
 	return nil
@@ -57,13 +78,31 @@ func (m *oauthMetrics) record(brand, country string, err error) {
 	if _, ok := m.allowed[metricTarget(brand, country)]; !ok {
 		return
 	}
-	if err != nil {
+	switch {
+	case errors.Is(err, context.Canceled):
+		m.aborted.WithLabelValues(brand, country).Inc()
+		return
+	case err != nil:
 		m.failure.WithLabelValues(brand, country).Inc()
 		return
 	}
 	m.success.WithLabelValues(brand, country).Inc()
 }
 
+func (m *oauthMetrics) recordExecutor(executor, brand, country string, err error) {
+	if _, ok := m.allowed[metricTarget(brand, country)]; !ok {
+		return
+	}
+	outcome := "success"
+	switch {
+	case errors.Is(err, context.Canceled):
+		outcome = "aborted"
+	case err != nil:
+		outcome = "failure"
+	}
+	m.executorAttempts.WithLabelValues(executor, brand, country, outcome).Inc()
+}
+
 func (m *oauthMetrics) handler() http.Handler {
 	return promhttp.HandlerFor(m.gather, promhttp.HandlerOpts{})
 }
@@ -1,7 +1,9 @@
 package app
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -45,9 +47,11 @@ func TestOAuthMetricsRecordOutcome(t *testing.T) {
 
 	metrics.record("MyPeugeot", "DE", nil)
 	metrics.record("MyPeugeot", "DE", errors.New("login failed"))
+	metrics.record("MyPeugeot", "DE", fmt.Errorf("%w: %w", errClientAborted, context.Canceled))
 
 	body := scrapeMetrics(t, metrics.handler())
 	for _, want := range []string{
+		`stelloauth_oauth_aborted_total{brand="MyPeugeot",country="DE"} 1`,
 		`stelloauth_oauth_failure_total{brand="MyPeugeot",country="DE"} 1`,
 		`stelloauth_oauth_success_total{brand="MyPeugeot",country="DE"} 1`,
 	} {
@@ -13,7 +13,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/chromedp/cdproto/input"
 	"github.com/chromedp/cdproto/network"
 	"github.com/chromedp/chromedp"
 )
@@ -21,52 +20,145 @@ import (
 type ProgressFunc func(step string)
 type DebugFunc func(msg string)
 
-type oauthExecutor func(
-	authURL, email, password, scheme, requestID string,
-	progress ProgressFunc, debug DebugFunc,
-) (string, error)
+// loginTrace holds hooks for the structured progress of a login, on top of
+// the plain progress messages. Like net/http/httptrace's ClientTrace it rides
+// in the context, so only the streaming callers need to know about it. Any
+// hook may be nil.
+type loginTrace struct {
+	// phase is called when the browser login enters a new phase, with the
+	// time since the browser started.
+	phase func(phase string, elapsed time.Duration)
+	// queue is called while the login waits for a free browser session, with
+	// its place in the queue (see SessionGate.Acquire).
+	queue func(status QueueStatus)
+}
+
+type loginTraceKey struct{}
+
+func withLoginTrace(ctx context.Context, trace *loginTrace) context.Context {
+	return context.WithValue(ctx, loginTraceKey{}, trace)
+}
+
+// loginTraceFrom returns the hooks of ctx; it never returns nil.
+func loginTraceFrom(ctx context.Context) *loginTrace {
+	if trace, ok := ctx.Value(loginTraceKey{}).(*loginTrace); ok {
+		return trace
+	}
+	return &loginTrace{}
+}
+
+// oauthAttempt is everything an executor needs to drive one login.
+type oauthAttempt struct {
+	brand     string
+	authURL   string
+	email     string
+	password  string
+	scheme    string
+	state     string // expected state on the redirect
+	locale    string // the country's locale, e.g. "it-IT"
+	requestID string
+	// try counts the attempts at this request (from 1); lease, when set, holds
+	// the browser slot across them.
+	try   int
+	lease *sessionLease
+}
+
+// fingerprint names the CloakBrowser session of this try. Each try gets a
+// fresh one so a retry does not inherit the expired session's state.
+func (a oauthAttempt) fingerprint() string {
+	if a.try <= 1 {
+		return a.requestID
+	}
+	return fmt.Sprintf("%s-%d", a.requestID, a.try)
+}
+
+// authCode is an authorization code and the time it was captured from the
+// redirect, which is when its short lifetime starts.
+type authCode struct {
+	value    string
+	issuedAt time.Time
+}
+
+// codeLifetime is how long ForgeRock accepts an authorization code (AM's
+// default is two minutes). It is only reported to the caller, not enforced.
+var codeLifetime = 2 * time.Minute
 
-func performOAuth(req OAuthRequest, requestID string, progress ProgressFunc, debug DebugFunc) (string, error) {
+// completeTimeout bounds the Home Assistant push or token exchange that
+// follows a captured code.
+const completeTimeout = 60 * time.Second
+
+// performOAuth logs in for req. ctx is the caller's request: when the client
+// disconnects, the login stops and its browser slot is freed.
+func performOAuth(ctx context.Context, req OAuthRequest, requestID string, progress ProgressFunc, debug DebugFunc) (*OAuthData, error) {
 	return performOAuthWithExecutor(
+		ctx,
 		req,
 		requestID,
 		progress,
 		debug,
 		applicationMetrics,
-		performChromedpOAuth,
+		executors,
 	)
 }
 
+// lookupConfig resolves the embedded brand and country configuration.
+func lookupConfig(brand, country string) (BrandConfig, CountryConfig, error) {
+	var configs map[string]BrandConfig
+	if err := json.Unmarshal(configsJSON, &configs); err != nil {
+		return BrandConfig{}, CountryConfig{}, fmt.Errorf("failed to parse configs: %v", err)
+	}
+
+	brandConfig, ok := configs[brand]
+	if !ok {
+		return BrandConfig{}, CountryConfig{}, fmt.Errorf("%w: %s", errUnknownBrand, brand)
+	}
+
+	countryConfig, ok := brandConfig.Configs[country]
+	if !ok {
+		return BrandConfig{}, CountryConfig{}, fmt.Errorf("%w for brand %s: %s", errUnknownCountry, brand, country)
+	}
+	return brandConfig, countryConfig, nil
+}
+
+// redirectURIFor returns the app redirect URI registered for a brand/country,
+// e.g. mymap://oauth2redirect/de.
+func redirectURIFor(brandConfig BrandConfig, country string) string {
+	return fmt.Sprintf("%s://oauth2redirect/%s", brandConfig.Scheme, strings.ToLower(country))
+}
+
 func performOAuthWithExecutor(
+	ctx context.Context,
 	req OAuthRequest,
 	requestID string,
 	progress ProgressFunc,
 	debug DebugFunc,
 	metrics *oauthMetrics,
-	execute oauthExecutor,
-) (string, error) {
+	executors *executorRegistry,
+) (*OAuthData, error) {
 	if progress != nil {
 		progress("Preparing authentication...")
 	}
-
-	// Parse embedded configs
-	var configs map[string]BrandConfig
-	if err := json.Unmarshal(configsJSON, &configs); err != nil {
-		return "", fmt.Errorf("failed to parse configs: %v", err)
+	// Logins that fail before reaching an executor are still reported.
+	fail := func(err error) (*OAuthData, error) {
+		metrics.record(req.Brand, req.Country, err)
+		webhooks.notify(newWebhookEvent(req, requestID, nil, err))
+		return nil, err
 	}
 
-	brandConfig, ok := configs[req.Brand]
-	if !ok {
-		return "", fmt.Errorf("unknown brand: %s", req.Brand)
+	brandConfig, countryConfig, err := lookupConfig(req.Brand, req.Country)
+	if err != nil {
+		return fail(err)
 	}
 
-	countryConfig, ok := brandConfig.Configs[req.Country]
-	if !ok {
-		return "", fmt.Errorf("unknown country for brand %s: %s", req.Brand, req.Country)
+	// PKCE is opt-in for callers that redeem the code themselves (a consumer
+	// unaware of PKCE could not redeem it), and always used when we exchange.
+	params, err := newAuthParams(req.PKCE || req.Exchange)
+	if err != nil {
+		return fail(err)
 	}
 
 	// Build authorization URL
-	redirectURI := fmt.Sprintf("%s://oauth2redirect/%s", brandConfig.Scheme, strings.ToLower(req.Country))
+	redirectURI := redirectURIFor(brandConfig, req.Country)
 	authURL := fmt.Sprintf(
 		"%s/am/oauth2/authorize?client_id=%s&response_type=code"+
 			"&redirect_uri=%s&scope=openid%%20profile%%20email&locale=%s",
@@ -74,52 +166,167 @@ func performOAuthWithExecutor(
 		countryConfig.ClientID,
 		url.QueryEscape(redirectURI),
 		countryConfig.Locale,
-	)
+	) + params.query()
 
 	log.Printf("[%s] Starting OAuth flow for %s/%s", requestID, req.Brand, req.Country)
 
-	code, err := execute(authURL, req.Email, req.Password, brandConfig.Scheme, requestID, progress, debug)
+	attempt := oauthAttempt{
+		brand:     req.Brand,
+		authURL:   authURL,
+		email:     req.Email,
+		password:  req.Password,
+		scheme:    brandConfig.Scheme,
+		state:     params.state,
+		locale:    countryConfig.Locale,
+		requestID: requestID,
+		lease:     &sessionLease{gate: sessionGate},
+	}
+	// An expired Stellantis session is not the user's fault: start over in a
+	// fresh browser session, keeping the slot, up to sessionRetries times.
+	var code authCode
+	var executor string
+	for attempt.try = 1; ; attempt.try++ {
+		code, executor, err = executors.run(ctx, req, attempt, brandConfig, countryConfig, progress, debug, metrics)
+		if !errors.Is(err, errSessionExpired) || attempt.try > sessionRetries {
+			break
+		}
+		msg := fmt.Sprintf("Session expired, retrying (%d/%d)", attempt.try+1, sessionRetries+1)
+		log.Printf("[%s] %s", requestID, msg)
+		if progress != nil {
+			progress(msg + "...")
+		}
+	}
+	attempt.lease.release()
+	if err != nil && ctx.Err() != nil {
+		// Whatever the executor made of it, the client went away (or a job
+		// ran out of time) first.
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("login timed out: %w", ctx.Err())
+		} else {
+			err = fmt.Errorf("%w: %w", errClientAborted, ctx.Err())
+		}
+	}
+	var data *OAuthData
+	if err == nil {
+		// The code is single-use and already captured: finish pushing or
+		// redeeming it even if the client has gone, or it would be lost.
+		completeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), completeTimeout)
+		data, err = completeOAuth(completeCtx, req, requestID, progress, brandConfig, countryConfig, params, code)
+		cancel()
+	}
+	if data != nil {
+		data.Executor = executor
+	}
+	// A failed exchange or id_token check fails the login, too.
 	metrics.record(req.Brand, req.Country, err)
-	return code, err
+	webhooks.notify(newWebhookEvent(req, requestID, data, err))
+	return data, err
 }
 
-func performChromedpOAuth(
-	authURL, email, password, scheme, requestID string,
-	progress ProgressFunc, debug DebugFunc,
-) (string, error) {
-	// Serialize browser use (CloakBrowser free tier = 1 session).
-	if err := sessionGate.Acquire(context.Background(), func() {
+// completeOAuth turns a captured code into the response: either the code
+// itself (optionally pushed to Home Assistant) or, with req.Exchange, the
+// verified tokens.
+func completeOAuth(
+	ctx context.Context,
+	req OAuthRequest,
+	requestID string,
+	progress ProgressFunc,
+	brandConfig BrandConfig,
+	countryConfig CountryConfig,
+	params authParams,
+	code authCode,
+) (*OAuthData, error) {
+	if !req.Exchange {
+		expiresAt := code.issuedAt.Add(codeLifetime)
+		data := &OAuthData{
+			Code:         code.value,
+			CodeVerifier: params.codeVerifier,
+			IssuedAt:     &code.issuedAt,
+			ExpiresIn:    int(codeLifetime.Seconds()),
+			ExpiresAt:    &expiresAt,
+		}
+		// Home Assistant redeems the code without a code_verifier, so a PKCE
+		// code is never pushed.
+		if target := homeAssistantTarget(req); target != nil && params.codeVerifier == "" {
+			if progress != nil {
+				progress("Sending code to Home Assistant...")
+			}
+			data.HomeAssistant = pushToHomeAssistant(ctx, haClient, target, req.Brand, req.Country, data)
+			log.Printf("[%s] Home Assistant push: %s %s", requestID, data.HomeAssistant.Status, data.HomeAssistant.Error)
+		}
+		return data, nil
+	}
+
+	// Redeem the code right away so the caller gets tokens instead of a
+	// short-lived code it has to race to paste somewhere.
+	if progress != nil {
+		progress("Exchanging code for tokens...")
+	}
+	redirectURI := redirectURIFor(brandConfig, req.Country)
+	data, err := exchangeCode(ctx, tokenClient, brandConfig, countryConfig, redirectURI, code.value, params.codeVerifier)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errTokenExchange, err)
+	}
+	if err := verifyTokens(idTokenKeys, data, brandConfig, countryConfig, params.nonce); err != nil {
+		return nil, err
+	}
+	log.Printf("[%s] Exchanged OAuth code for tokens", requestID)
+	return data, nil
+}
+
+func performChromedpOAuth(reqCtx context.Context, attempt oauthAttempt, progress ProgressFunc, debug DebugFunc) (authCode, error) {
+	requestID := attempt.requestID
+
+	flowName, flow, err := flowFor(attempt.brand)
+	if err != nil {
+		return authCode{}, err
+	}
+
+	// Serialize browser use (CloakBrowser free tier = 1 session). A request
+	// that retries holds its slot across tries through attempt.lease.
+	lease := attempt.lease
+	if lease == nil {
+		lease = &sessionLease{gate: sessionGate}
+		defer lease.release()
+	}
+	hooks := loginTraceFrom(reqCtx)
+	if err := lease.acquire(reqCtx, func(status QueueStatus) {
 		if progress != nil {
-			progress("Waiting for a free browser slot...")
+			progress(status.String() + "...")
+		}
+		if hooks.queue != nil {
+			hooks.queue(status)
 		}
 	}); err != nil {
 		if err == ErrSessionBusy {
-			return "", fmt.Errorf("service is busy, please try again in a few seconds")
+			return authCode{}, errServiceBusy
 		}
-		return "", err
+		return authCode{}, err
 	}
-	defer sessionGate.Release()
 
 	// Report real elapsed time via a heartbeat goroutine (the sole progress
 	// writer); the flow below only updates the phase label via setPhase. This
 	// keeps progress moving during the long blocking waits (page load, login)
 	// that would otherwise be silent.
-	setPhase, stopHeartbeat := startProgressHeartbeat(progress)
+	setPhase, stopHeartbeat := startProgressHeartbeat(progress, hooks.phase)
 	defer stopHeartbeat()
 
 	// Create context with timeout. Some brands (e.g. Opel) are slow and a full
-	// login + consent can take ~2 minutes, so allow generous headroom.
-	ctx, cancel := context.WithTimeout(context.Background(), 180*time.Second)
+	// login + consent can take ~2 minutes, so allow generous headroom. It is not
+	// derived from the request's cancellation: a client that disconnects closes
+	// the browser below, gracefully, instead of dropping the websocket.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(reqCtx), 180*time.Second)
 	defer cancel()
 
 	// Connect to the CloakBrowser stealth-Chromium CDP endpoint. CloakBrowser
 	// owns the fingerprint, so we pass no Chrome flags of our own.
 	// Use the requestID as a unique fingerprint so each request gets an isolated
-	// CloakBrowser session (avoids state leaking/wedging between requests).
+	// CloakBrowser session (avoids state leaking/wedging between requests); see
+	// oauthAttempt.fingerprint for retries.
 	cdpURL := os.Getenv("CLOAK_CDP_URL")
-	wsURL, err := discoverCDPWebSocketURL(cdpURL, requestID, &http.Client{Timeout: 10 * time.Second})
+	wsURL, err := discoverCDPWebSocketURL(cdpURL, attempt.fingerprint(), &http.Client{Timeout: 10 * time.Second})
 	if err != nil {
-		return "", fmt.Errorf("browser backend unavailable: %v", err)
+		return authCode{}, fmt.Errorf("%w: %v", errBackendUnavailable, err)
 	}
 
 	allocCtx, allocCancel := chromedp.NewRemoteAllocator(ctx, wsURL)
@@ -132,16 +339,28 @@ func performChromedpOAuth(
 	// Gracefully close the page target on exit before the websocket drops, so
 	// CloakBrowser tears the session down cleanly and reclaims its memory;
 	// chromedp.Cancel waits for that, browserCancel is the fallback if it errors.
-	defer func() {
-		if err := chromedp.Cancel(browserCtx); err != nil {
-			log.Printf("[%s] browser context cleanup failed: %v", requestID, err)
-		}
-		browserCancel()
-	}()
+	// A client disconnect does the same right away, which fails the flow's
+	// pending actions and so frees the browser slot without waiting them out.
+	var closeOnce sync.Once
+	closeBrowser := func() {
+		closeOnce.Do(func() {
+			if err := chromedp.Cancel(browserCtx); err != nil {
+				log.Printf("[%s] browser context cleanup failed: %v", requestID, err)
+			}
+			browserCancel()
+		})
+	}
+	defer closeBrowser()
+	stopAbortWatch := context.AfterFunc(reqCtx, func() {
+		log.Printf("[%s] Client disconnected, closing the browser", requestID)
+		closeBrowser()
+	})
+	defer stopAbortWatch()
 
 	var oauthCode string
+	var issuedAt time.Time
 	var flowError string // captured Stellantis OPErrorPage.php error, if any
-	redirectPrefix := scheme + "://"
+	redirectPrefix := attempt.scheme + "://"
 
 	// Domains relevant to the OAuth flow (for debug output filtering)
 	relevantDomains := []string{
@@ -157,20 +376,30 @@ func performChromedpOAuth(
 		return false
 	}
 
+	log.Printf("[%s] Running login flow %s v%d", requestID, flowName, flow.Version)
+
+	// Record the traffic for the failure trace, and watch for Gigya rejecting
+	// the login.
+	trace := newHARRecorder()
+	gigya := newGigyaLoginWatch(browserCtx, requestID)
+
 	// Set up listener for network events to catch the redirect (which fails because browser can't load custom schemes)
 	chromedp.ListenTarget(browserCtx, func(ev any) {
+		trace.observe(ev)
+		gigya.observe(ev)
 		switch e := ev.(type) {
 		case *network.EventRequestWillBeSent:
 			reqURL := e.Request.URL
 			// Capture OAuth redirect
 			if strings.HasPrefix(reqURL, redirectPrefix) {
 				log.Printf("[%s] Redirect URL: %s", requestID, reqURL)
-				parsed, err := url.Parse(reqURL)
-				if err == nil {
-					if code := parsed.Query().Get("code"); code != "" {
-						oauthCode = code
-						log.Printf("[%s] Captured OAuth code from redirect request", requestID)
-					}
+				code, err := redirectCode(reqURL, attempt.state)
+				if err != nil {
+					log.Printf("[%s] Ignoring redirect: %v", requestID, err)
+				} else if code != "" {
+					oauthCode = code
+					issuedAt = time.Now().UTC()
+					log.Printf("[%s] Captured OAuth code from redirect request", requestID)
 				}
 			} else if strings.Contains(reqURL, "OPErrorPage.php") {
 				// Stellantis redirects here when the flow fails (e.g. an expired
@@ -186,187 +415,47 @@ func performChromedpOAuth(
 		}
 	})
 
-	// Selectors for Gigya login form (used by Stellantis)
-	const (
-		emailSelector    = `#gigya-login-form input[name="username"]`
-		passwordSelector = `#gigya-login-form input[name="password"]`
-		submitSelector   = `#gigya-login-form input[type="submit"]`
-	)
-
-	// Possible authorization form selectors (different pages use different forms)
-	// Order matters - more specific selectors first
-	// ForgeRock AM uses name="decision" with value="allow" or name="allow"
-	authorizeSelectors := []string{
-		`#consentbutton`, // DCR consent page ("CONTINUE") — post-login authorize
-		`input[name="decision"][value="allow"]`,
-		`button[name="decision"][value="allow"]`,
-		`#allow`,
-		`input[name="allow"]`,
-		`button[name="allow"]`,
-		`input[type="submit"][value="Allow"]`,
-		`input[type="submit"][value="Erlauben"]`,  // German
-		`input[type="submit"][value="Autoriser"]`, // French
-		`#cvs_from input[type="submit"]`,
-	}
-
-	// Run the OAuth flow
-	setPhase("Loading login page")
-	err = chromedp.Run(browserCtx,
-		network.Enable(),
-		chromedp.Navigate(authURL),
-		chromedp.WaitReady("body"),
-	)
-	if err != nil {
-		return "", fmt.Errorf("failed to navigate: %v", err)
+	// fail keeps a screenshot of the page the login got stuck on and the
+	// network trace that led there.
+	fail := func(err error) (authCode, error) {
+		captureFailureScreenshot(browserCtx, requestID)
+		captureFailureTrace(trace, attempt)
+		return authCode{}, err
 	}
 
-	// Wait for the Gigya login form to appear
-	setPhase("Waiting for login form")
-	err = chromedp.Run(browserCtx,
-		chromedp.WaitVisible(emailSelector, chromedp.ByQuery),
-	)
-	if err != nil {
-		// Log what we see on the page
-		var pageHTML string
-		_ = chromedp.Run(browserCtx, chromedp.OuterHTML("html", &pageHTML))
-		log.Printf("Page HTML length: %d", len(pageHTML))
-		return "", fmt.Errorf("login form not found (timeout): %v", err)
-	}
-
-	// Wait until the whole login form (incl. submit button) has rendered, then
-	// fill credentials. Stellantis silently drops CDP synthetic key/mouse events
-	// on the Gigya login page (SendKeys/Click never reach the node, leaving the
-	// field empty), so type via Input.insertText into the focused field instead;
-	// it lands and fires the input event Gigya's validation listens for. Settle
-	// briefly first for a cold browser.
-	setPhase("Entering credentials")
-	err = chromedp.Run(browserCtx,
-		chromedp.WaitVisible(passwordSelector, chromedp.ByQuery),
-		chromedp.WaitVisible(submitSelector, chromedp.ByQuery),
-		chromedp.Sleep(1500*time.Millisecond),
-		chromedp.Focus(emailSelector, chromedp.ByQuery),
-		input.InsertText(email),
-		chromedp.Sleep(300*time.Millisecond),
-		chromedp.Focus(passwordSelector, chromedp.ByQuery),
-		input.InsertText(password),
-		chromedp.Sleep(500*time.Millisecond),
-	)
-	if err != nil {
-		return "", fmt.Errorf("failed to fill credentials: %v", err)
+	err = runLoginFlow(browserCtx, flow, attempt, setPhase,
+		func() bool { return oauthCode != "" || flowError != "" || gigya.failed() != nil })
+	if abortErr := reqCtx.Err(); abortErr != nil {
+		// Nobody to report to, and the page is gone; skip the diagnostics.
+		return authCode{}, abortErr
 	}
-
-	// Submit the login form. Synthetic CDP clicks are dropped on this page (see
-	// above), so trigger submission via a DOM element.click() instead.
-	setPhase("Signing in")
-	if err := jsClick(browserCtx, submitSelector); err != nil {
-		return "", fmt.Errorf("failed to submit login: %v", err)
+	if loginErr := gigya.failed(); loginErr != nil && oauthCode == "" {
+		return fail(loginErr)
 	}
-
-	// Grace period for a direct redirect (heartbeat reports elapsed time).
-	for range 5 {
-		if oauthCode != "" || flowError != "" {
-			break
-		}
-		_ = chromedp.Run(browserCtx, chromedp.Sleep(2*time.Second))
-	}
-
-	// Check if we captured the code already (direct redirect)
-	if oauthCode != "" {
-		setPhase("Authentication successful")
-		return oauthCode, nil
-	}
-
-	// Check for login errors
-	var errorText string
-	_ = chromedp.Run(browserCtx,
-		chromedp.Evaluate(`
-			(function() {
-				var error = document.querySelector('.gigya-error-msg, .error-message, [class*="error"]');
-				if (error && error.textContent.trim()) {
-					return error.textContent.trim();
-				}
-				return '';
-			})()
-		`, &errorText),
-	)
-	if errorText != "" {
-		return "", fmt.Errorf("authentication failed: %s", errorText)
+	if err != nil {
+		return fail(err)
 	}
 
-	// Wait for authorization confirmation page (if present)
-	setPhase("Waiting for authorization")
-
-	// Give the page time to render
-	_ = chromedp.Run(browserCtx, chromedp.Sleep(2*time.Second))
-
-	// Handle the post-login authorization/consent page (if present) and wait
-	// for the resulting redirect (or an error page).
-	clickAuthorizeAndWait(browserCtx, authorizeSelectors, requestID, setPhase,
-		func() bool { return oauthCode != "" || flowError != "" })
-
 	// If we captured the code, return it
 	if oauthCode != "" {
 		setPhase("Authentication successful")
-		return oauthCode, nil
+		return authCode{value: oauthCode, issuedAt: issuedAt}, nil
 	}
 
 	// Surface a Stellantis error page (e.g. expired contextId) with a clear message.
 	if flowError != "" {
 		if flowError == msgSessionExpired {
-			return "", errSessionExpired
+			return fail(errSessionExpired)
 		}
-		return "", fmt.Errorf("authentication failed: %s", flowError)
+		return fail(fmt.Errorf("%w: %s", errStellantis, flowError))
 	}
 
 	// Last resort: the redirect may already be the current URL.
-	if code := codeFromLocation(browserCtx, redirectPrefix); code != "" {
-		return code, nil
+	if code := codeFromLocation(browserCtx, redirectPrefix, attempt.state); code != "" {
+		return authCode{value: code, issuedAt: time.Now().UTC()}, nil
 	}
 
-	return "", fmt.Errorf("authentication failed - could not retrieve OAuth code")
-}
-
-// clickAuthorizeAndWait looks for a post-login authorization/consent control,
-// clicks the first one found, and then waits for the OAuth redirect to be
-// captured. codeSet reports whether the redirect code has already arrived. The
-// consent page can render slowly (notably Citroen: heavy fonts/select2), so the
-// selector scan is retried until a deadline rather than in a single pass.
-func clickAuthorizeAndWait(
-	browserCtx context.Context, selectors []string, requestID string,
-	setPhase func(string), codeSet func() bool,
-) {
-	const findDeadline = 60 * time.Second
-	deadline := time.Now().Add(findDeadline)
-
-	var authorizeFound bool
-	for !authorizeFound && !codeSet() && time.Now().Before(deadline) {
-		for _, selector := range selectors {
-			checkCtx, checkCancel := context.WithTimeout(browserCtx, 1500*time.Millisecond)
-			err := chromedp.Run(checkCtx, chromedp.WaitVisible(selector, chromedp.ByQuery))
-			checkCancel()
-
-			if err == nil {
-				authorizeFound = true
-				setPhase("Confirming authorization")
-				log.Printf("[%s] Found authorize button with selector: %s", requestID, selector)
-				// element.click() — synthetic CDP clicks are dropped on the consent page.
-				_ = jsClick(browserCtx, selector)
-				break
-			}
-		}
-	}
-
-	if !authorizeFound {
-		return
-	}
-
-	setPhase("Waiting for redirect")
-	for range 10 {
-		if codeSet() {
-			break
-		}
-		_ = chromedp.Run(browserCtx, chromedp.Sleep(2*time.Second))
-	}
+	return fail(errNoRedirect)
 }
 
 // jsClick clicks the first element matching selector via a DOM element.click().
@@ -374,13 +463,9 @@ func clickAuthorizeAndWait(
 // real chromedp.Click never reaches the node; element.click() does. The selector
 // is JSON-encoded to embed safely (it may contain quotes/brackets).
 func jsClick(ctx context.Context, selector string) error {
-	sel, err := json.Marshal(selector)
-	if err != nil {
-		return err
-	}
 	var ok bool
 	return chromedp.Run(ctx, chromedp.Evaluate(
-		fmt.Sprintf(`(function(){var e=document.querySelector(%s);if(!e)return false;e.click();return true;})()`, sel),
+		fmt.Sprintf(`(function(){var e=document.querySelector(%s);if(!e)return false;e.click();return true;})()`, jsString(selector)),
 		&ok,
 	))
 }
@@ -390,19 +475,27 @@ func jsClick(ctx context.Context, selector string) error {
 // writer; callers change the reported phase via the returned setPhase. stop()
 // waits for the goroutine to exit so it never writes concurrently with a later
 // event. When progress is nil, setPhase is a no-op sink and stop() does nothing.
-func startProgressHeartbeat(progress ProgressFunc) (setPhase func(string), stop func()) {
+// onPhase, if set, is told about every change of phase as it happens.
+func startProgressHeartbeat(progress ProgressFunc, onPhase func(string, time.Duration)) (setPhase func(string), stop func()) {
 	var mu sync.Mutex
+	start := time.Now()
 	phase := "Starting browser"
+	if onPhase != nil {
+		onPhase(phase, 0)
+	}
 	setPhase = func(p string) {
 		mu.Lock()
+		changed := p != phase
 		phase = p
 		mu.Unlock()
+		if changed && onPhase != nil {
+			onPhase(p, time.Since(start))
+		}
 	}
 	if progress == nil {
 		return setPhase, func() {}
 	}
 
-	start := time.Now()
 	done := make(chan struct{})
 	var wg sync.WaitGroup
 	wg.Go(func() {
@@ -431,6 +524,33 @@ const msgSessionExpired = "the login took too long and the session expired, plea
 
 var errSessionExpired = errors.New(msgSessionExpired)
 
+// sessionRetries is how many times a login is started over after the session
+// expired, before errSessionExpired is returned (set up in Run).
+var sessionRetries = 2
+
+// Sentinels for the other failure classes callers (and clients, see
+// errorCodeOf) tell apart. Specific errors wrap them.
+var (
+	errServiceBusy        = errors.New("service is busy, please try again in a few seconds")
+	errBackendUnavailable = errors.New("browser backend unavailable")
+	errAuthFailed         = errors.New("authentication failed")
+	errTokenExchange      = errors.New("token exchange failed")
+	errUnknownBrand       = errors.New("unknown brand")
+	errUnknownCountry     = errors.New("unknown country")
+	errClientAborted      = errors.New("client disconnected")
+)
+
+// Cases of errAuthFailed; their messages are the same. errCredentialsRejected
+// (and errAccountLocked, which wraps it) end a login without trying another
+// executor.
+var (
+	errCredentialsRejected = fmt.Errorf("%w", errAuthFailed)
+	errAccountLocked       = fmt.Errorf("%w", errCredentialsRejected)
+	errCaptchaBlocked      = fmt.Errorf("%w", errAuthFailed)
+	errStellantis          = fmt.Errorf("%w", errAuthFailed) // a Stellantis error page
+	errNoRedirect          = fmt.Errorf("%w - could not retrieve OAuth code", errAuthFailed)
+)
+
 // friendlyOPError turns a Stellantis OPErrorPage.php code/message into a
 // user-facing error string. Stellantis encodes spaces as '+', so it is decoded
 // back to spaces; the expired-contextId case gets a clear retry hint.
@@ -450,17 +570,18 @@ func friendlyOPError(code, message string) string {
 }
 
 // codeFromLocation returns the OAuth code if the current page URL is the
-// custom-scheme redirect carrying it, otherwise "".
-func codeFromLocation(browserCtx context.Context, redirectPrefix string) string {
+// custom-scheme redirect carrying it (with the expected state), otherwise "".
+func codeFromLocation(browserCtx context.Context, redirectPrefix, state string) string {
 	var currentURL string
 	_ = chromedp.Run(browserCtx, chromedp.Location(&currentURL))
 	log.Printf("Current URL: %s", currentURL)
 	if !strings.HasPrefix(currentURL, redirectPrefix) {
 		return ""
 	}
-	parsed, err := url.Parse(currentURL)
+	code, err := redirectCode(currentURL, state)
 	if err != nil {
+		log.Printf("Ignoring redirect: %v", err)
 		return ""
 	}
-	return parsed.Query().Get("code")
+	return code
 }
@@ -1,9 +1,13 @@
 package app
 
 import (
+	"context"
 	"errors"
+	"net/url"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestFriendlyOPError(t *testing.T) {
@@ -59,17 +63,24 @@ func TestPerformOAuthWithExecutorRecordsSuccess(t *testing.T) {
 		Password: "secret",
 	}
 
-	code, err := performOAuthWithExecutor(
-		req, "request-id", nil, nil, metrics,
-		func(_, _, _, _, _ string, _ ProgressFunc, _ DebugFunc) (string, error) {
-			return "oauth-code", nil
-		},
+	issuedAt := time.Now().UTC()
+	data, err := performOAuthWithExecutor(
+		context.Background(), req, "request-id", nil, nil, metrics,
+		stubExecutors(func(_ oauthAttempt, _ ProgressFunc, _ DebugFunc) (authCode, error) {
+			return authCode{value: "oauth-code", issuedAt: issuedAt}, nil
+		}),
 	)
 	if err != nil {
 		t.Fatalf("performOAuthWithExecutor() error = %v", err)
 	}
-	if code != "oauth-code" {
-		t.Fatalf("code = %q, want %q", code, "oauth-code")
+	if data.Code != "oauth-code" {
+		t.Fatalf("code = %q, want %q", data.Code, "oauth-code")
+	}
+	if data.IssuedAt == nil || !data.IssuedAt.Equal(issuedAt) || data.ExpiresIn != int(codeLifetime.Seconds()) {
+		t.Errorf("issued_at = %v, expires_in = %d; want capture time and code lifetime", data.IssuedAt, data.ExpiresIn)
+	}
+	if data.ExpiresAt == nil || !data.ExpiresAt.Equal(issuedAt.Add(codeLifetime)) {
+		t.Errorf("expires_at = %v, want issued_at + code lifetime", data.ExpiresAt)
 	}
 
 	body := scrapeMetrics(t, metrics.handler())
@@ -92,10 +103,10 @@ func TestPerformOAuthWithExecutorRecordsFailure(t *testing.T) {
 	wantErr := errors.New("login failed")
 
 	_, err := performOAuthWithExecutor(
-		req, "request-id", nil, nil, metrics,
-		func(_, _, _, _, _ string, _ ProgressFunc, _ DebugFunc) (string, error) {
-			return "", wantErr
-		},
+		context.Background(), req, "request-id", nil, nil, metrics,
+		stubExecutors(func(_ oauthAttempt, _ ProgressFunc, _ DebugFunc) (authCode, error) {
+			return authCode{}, wantErr
+		}),
 	)
 	if !errors.Is(err, wantErr) {
 		t.Fatalf("performOAuthWithExecutor() error = %v, want %v", err, wantErr)
@@ -106,3 +117,93 @@ func TestPerformOAuthWithExecutorRecordsFailure(t *testing.T) {
 		t.Fatalf("failure metric not incremented:\n%s", body)
 	}
 }
+
+func TestPerformOAuthWithExecutorBindsStateAndPKCE(t *testing.T) {
+	req := OAuthRequest{
+		Brand:    "MyPeugeot",
+		Country:  "DE",
+		Email:    "driver@example.com",
+		Password: "secret",
+		PKCE:     true,
+	}
+
+	var got oauthAttempt
+	data, err := performOAuthWithExecutor(
+		context.Background(), req, "request-id", nil, nil, newOAuthMetrics(),
+		stubExecutors(func(attempt oauthAttempt, _ ProgressFunc, _ DebugFunc) (authCode, error) {
+			got = attempt
+			return authCode{value: "oauth-code", issuedAt: time.Now()}, nil
+		}),
+	)
+	if err != nil {
+		t.Fatalf("performOAuthWithExecutor() error = %v", err)
+	}
+
+	parsed, err := url.Parse(got.authURL)
+	if err != nil {
+		t.Fatalf("parse authURL: %v", err)
+	}
+	q := parsed.Query()
+	if got.state == "" || q.Get("state") != got.state {
+		t.Errorf("authURL state = %q, executor state = %q", q.Get("state"), got.state)
+	}
+	if q.Get("nonce") == "" {
+		t.Error("authURL carries no nonce")
+	}
+	if data.CodeVerifier == "" || q.Get("code_challenge") != pkceChallenge(data.CodeVerifier) {
+		t.Errorf("code_challenge %q does not match returned verifier %q", q.Get("code_challenge"), data.CodeVerifier)
+	}
+}
+
+func TestPerformOAuthWithExecutorRetriesExpiredSession(t *testing.T) {
+	orig := sessionRetries
+	sessionRetries = 2
+	t.Cleanup(func() { sessionRetries = orig })
+	req := OAuthRequest{Brand: "MyPeugeot", Country: "DE", Email: "driver@example.com", Password: "secret"}
+
+	var fingerprints []string
+	var leases []*sessionLease
+	var progress []string
+	data, err := performOAuthWithExecutor(
+		context.Background(), req, "request-id", func(msg string) { progress = append(progress, msg) }, nil, newOAuthMetrics(),
+		stubExecutors(func(attempt oauthAttempt, _ ProgressFunc, _ DebugFunc) (authCode, error) {
+			fingerprints = append(fingerprints, attempt.fingerprint())
+			leases = append(leases, attempt.lease)
+			if len(fingerprints) < 3 {
+				return authCode{}, errSessionExpired
+			}
+			return authCode{value: "the-code", issuedAt: time.Now()}, nil
+		}),
+	)
+	if err != nil || data.Code != "the-code" {
+		t.Fatalf("performOAuthWithExecutor() = %+v, %v; want the code", data, err)
+	}
+	if want := []string{"request-id", "request-id-2", "request-id-3"}; !slices.Equal(fingerprints, want) {
+		t.Errorf("fingerprints = %v, want %v", fingerprints, want)
+	}
+	if leases[0] == nil || leases[0] != leases[2] {
+		t.Error("tries should share one session lease")
+	}
+	if !slices.Contains(progress, "Session expired, retrying (3/3)...") {
+		t.Errorf("progress = %q, want the retry count", progress)
+	}
+}
+
+func TestPerformOAuthWithExecutorGivesUpOnExpiredSession(t *testing.T) {
+	orig := sessionRetries
+	sessionRetries = 1
+	t.Cleanup(func() { sessionRetries = orig })
+	req := OAuthRequest{Brand: "MyPeugeot", Country: "DE", Email: "driver@example.com", Password: "secret"}
+
+	tries := 0
+	_, err := performOAuthWithExecutor(
+		context.Background(), req, "request-id", nil, nil, newOAuthMetrics(),
+		stubExecutors(func(oauthAttempt, ProgressFunc, DebugFunc) (authCode, error) {
+			tries++
+			return authCode{}, errSessionExpired
+		}),
+	)
+	if !errors.Is(err, errSessionExpired) || tries != 2 {
+		t.Fatalf("error = %v after %d tries, want errSessionExpired after 2", err, tries)
+	}
+}
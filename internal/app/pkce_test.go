@@ -0,0 +1,68 @@
+package app
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestPKCEChallenge(t *testing.T) {
+	// BASE64URL(SHA256(verifier)) without padding.
+	got := pkceChallenge("dBjftJeZ4CVP-mJ92K9VQE8pE8tv4vgWW5wmsnTVb2s")
+	if want := "dIXz5UXivFETOEIMaaDY1DNqgPWG3bOGuh8yzOAFWyk"; got != want {
+		t.Errorf("pkceChallenge() = %q, want %q", got, want)
+	}
+}
+
+func TestNewAuthParams(t *testing.T) {
+	p, err := newAuthParams(false)
+	if err != nil {
+		t.Fatalf("newAuthParams() error = %v", err)
+	}
+	if p.state == "" || p.nonce == "" || p.state == p.nonce {
+		t.Errorf("state/nonce not generated independently: %+v", p)
+	}
+	if p.codeVerifier != "" || p.codeChallenge != "" {
+		t.Errorf("PKCE pair generated without PKCE: %+v", p)
+	}
+
+	p, err = newAuthParams(true)
+	if err != nil {
+		t.Fatalf("newAuthParams() error = %v", err)
+	}
+	if len(p.codeVerifier) < 43 || p.codeChallenge != pkceChallenge(p.codeVerifier) {
+		t.Errorf("invalid PKCE pair: %+v", p)
+	}
+	q, err := url.ParseQuery(p.query()[1:])
+	if err != nil {
+		t.Fatalf("parse query: %v", err)
+	}
+	if q.Get("state") != p.state || q.Get("nonce") != p.nonce ||
+		q.Get("code_challenge") != p.codeChallenge || q.Get("code_challenge_method") != "S256" {
+		t.Errorf("query() = %q does not carry the params", p.query())
+	}
+}
+
+func TestRedirectCode(t *testing.T) {
+	cases := []struct {
+		name    string
+		url     string
+		want    string
+		wantErr bool
+	}{
+		{name: "matching state", url: "mymap://oauth2redirect/de?code=abc&state=s1", want: "abc"},
+		{name: "mismatched state", url: "mymap://oauth2redirect/de?code=abc&state=other", wantErr: true},
+		{name: "missing state", url: "mymap://oauth2redirect/de?code=abc", wantErr: true},
+		{name: "no code", url: "mymap://oauth2redirect/de?state=s1"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := redirectCode(tc.url, "s1")
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("redirectCode() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("redirectCode() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
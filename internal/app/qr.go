@@ -0,0 +1,149 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// qrTTL bounds how long a code waits in memory for its QR code to be fetched.
+const qrTTL = 5 * time.Minute
+
+// qrPNGSize is the edge length of /oauth/{requestID}/qr.png in pixels.
+const qrPNGSize = 320
+
+// haConfigFlowLink opens the Stellantis Vehicles config flow in the Home
+// Assistant companion app (via My Home Assistant).
+const haConfigFlowLink = "https://my.home-assistant.io/redirect/config_flow_start/?domain=" + haDomain
+
+// qrCodes holds codes captured over SSE until their QR code is fetched.
+var qrCodes = newQRStore(qrTTL)
+
+// qrStore keeps codes in memory only, keyed by request ID. A code is removed
+// on its first retrieval or once ttl has passed, whichever comes first.
+type qrStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]qrEntry
+}
+
+type qrEntry struct {
+	code    string
+	expires time.Time
+}
+
+func newQRStore(ttl time.Duration) *qrStore {
+	return &qrStore{ttl: ttl, entries: make(map[string]qrEntry)}
+}
+
+// put stores code for requestID and drops expired entries.
+func (s *qrStore) put(requestID, code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for id, e := range s.entries {
+		if now.After(e.expires) {
+			delete(s.entries, id)
+		}
+	}
+	s.entries[requestID] = qrEntry{code: code, expires: now.Add(s.ttl)}
+}
+
+// take returns and forgets the code for requestID.
+func (s *qrStore) take(requestID string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[requestID]
+	delete(s.entries, requestID)
+	if !ok || time.Now().After(e.expires) {
+		return "", false
+	}
+	return e.code, true
+}
+
+// has reports whether an unexpired code is waiting for requestID.
+func (s *qrStore) has(requestID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[requestID]
+	return ok && !time.Now().After(e.expires)
+}
+
+// qrURL is the path the SSE success event advertises for requestID's QR code.
+func qrURL(requestID string) string {
+	return "/oauth/" + requestID + "/qr.png"
+}
+
+// qrContent resolves what a QR request should encode: the code itself (which
+// consumes it), or with ?content=ha the Home Assistant deep link (which does
+// not, so the code can be scanned next).
+func qrContent(w http.ResponseWriter, r *http.Request) (string, bool) {
+	requestID := r.PathValue("requestID")
+	switch r.URL.Query().Get("content") {
+	case "":
+		if code, ok := qrCodes.take(requestID); ok {
+			return code, true
+		}
+	case "ha":
+		if qrCodes.has(requestID) {
+			return haConfigFlowLink, true
+		}
+	default:
+		sendError(w, codeInvalidRequest, "Unknown QR content: "+r.URL.Query().Get("content"))
+		return "", false
+	}
+	sendError(w, codeNotFound, "code not found or already retrieved")
+	return "", false
+}
+
+func handleQRPNG(w http.ResponseWriter, r *http.Request) {
+	content, ok := qrContent(w, r)
+	if !ok {
+		return
+	}
+	png, err := qrcode.Encode(content, qrcode.Medium, qrPNGSize)
+	if err != nil {
+		sendError(w, codeInternal, "failed to render QR code")
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write(png)
+}
+
+func handleQRSVG(w http.ResponseWriter, r *http.Request) {
+	content, ok := qrContent(w, r)
+	if !ok {
+		return
+	}
+	q, err := qrcode.New(content, qrcode.Medium)
+	if err != nil {
+		sendError(w, codeInternal, "failed to render QR code")
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write([]byte(qrSVG(q.Bitmap())))
+}
+
+// qrSVG draws a QR bitmap (quiet zone included) as one path of unit squares.
+func qrSVG(bitmap [][]bool) string {
+	var path strings.Builder
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	n := len(bitmap)
+	return fmt.Sprintf(
+		`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+
+			`<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="%s"/></svg>`,
+		n, n, n, n, path.String(),
+	)
+}
@@ -0,0 +1,95 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQRStoreIsOneTime(t *testing.T) {
+	store := newQRStore(time.Minute)
+	store.put("req", "the-code")
+
+	if code, ok := store.take("req"); !ok || code != "the-code" {
+		t.Fatalf("take() = %q, %v; want the-code", code, ok)
+	}
+	if _, ok := store.take("req"); ok {
+		t.Error("second take() should find nothing")
+	}
+}
+
+func TestQRStoreExpires(t *testing.T) {
+	store := newQRStore(0)
+	store.put("req", "the-code")
+	time.Sleep(time.Millisecond)
+
+	if store.has("req") {
+		t.Error("has() should be false after ttl")
+	}
+	if _, ok := store.take("req"); ok {
+		t.Error("take() should not return an expired code")
+	}
+}
+
+func TestHandleQRPNG(t *testing.T) {
+	setGlobal(t, &qrCodes, newQRStore(time.Minute)).put("req", "the-code")
+	mux := newApplicationMux()
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, qrURL("req"), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if !bytes.HasPrefix(w.Body.Bytes(), []byte("\x89PNG")) {
+		t.Error("body is not a PNG")
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, qrURL("req"), nil))
+	var resp OAuthResponse
+	_ = json.NewDecoder(w.Body).Decode(&resp)
+	if w.Code != http.StatusNotFound || resp.ErrorCode != codeNotFound {
+		t.Errorf("second fetch: status %d, error_code %q; want 404 %q", w.Code, resp.ErrorCode, codeNotFound)
+	}
+}
+
+func TestHandleQRSVGHomeAssistantLink(t *testing.T) {
+	setGlobal(t, &qrCodes, newQRStore(time.Minute)).put("req", "the-code")
+	mux := newApplicationMux()
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/oauth/req/qr.svg?content=ha", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "image/svg+xml" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if !strings.HasPrefix(w.Body.String(), "<svg") || !strings.Contains(w.Body.String(), `<path fill="#000" d="M`) {
+		t.Errorf("unexpected SVG: %.80s", w.Body.String())
+	}
+
+	// The deep link does not consume the code.
+	if !qrCodes.has("req") {
+		t.Error("code was consumed by the Home Assistant link")
+	}
+}
+
+func TestHandleQRUnknownContent(t *testing.T) {
+	setGlobal(t, &qrCodes, newQRStore(time.Minute)).put("req", "the-code")
+
+	w := httptest.NewRecorder()
+	newApplicationMux().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/oauth/req/qr.png?content=nope", nil))
+	var resp OAuthResponse
+	_ = json.NewDecoder(w.Body).Decode(&resp)
+	if w.Code != http.StatusBadRequest || resp.ErrorCode != codeInvalidRequest {
+		t.Errorf("status %d, error_code %q; want 400 %q", w.Code, resp.ErrorCode, codeInvalidRequest)
+	}
+}
@@ -1,15 +1,16 @@
 package app
 
 import (
+	"context"
 	_ "embed"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"net/netip"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -29,29 +30,86 @@ type OAuthRequest struct {
 	Country  string `json:"country"`
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	// Exchange redeems the captured code for tokens before responding.
+	Exchange bool `json:"exchange"`
+	// PKCE adds an S256 code_challenge to the authorization request and returns
+	// the matching code_verifier with the code. Implied by Exchange.
+	PKCE bool `json:"pkce"`
+	// HomeAssistant names an instance to push the code to instead of the
+	// operator default (requires HOME_ASSISTANT_ALLOW_USER_TARGETS).
+	HomeAssistant *HomeAssistantTarget `json:"home_assistant,omitempty"`
+}
+
+// TokenRequest is the body of /token: an authorization code to redeem for the
+// given brand/country client.
+type TokenRequest struct {
+	Brand   string `json:"brand"`
+	Country string `json:"country"`
+	Code    string `json:"code"`
+	// CodeVerifier is required when the code was obtained with "pkce": true.
+	CodeVerifier string `json:"code_verifier"`
+}
+
+// RefreshRequest is the body of /token/refresh.
+type RefreshRequest struct {
+	Brand        string `json:"brand"`
+	Country      string `json:"country"`
+	RefreshToken string `json:"refresh_token"`
 }
 
 type OAuthResponse struct {
 	Status  string     `json:"status"`
 	Message string     `json:"message,omitempty"`
 	Data    *OAuthData `json:"data,omitempty"`
+	// ErrorCode classifies an error response (see errorCodeOf).
+	ErrorCode errorCode `json:"error_code,omitempty"`
+	// Export is the result rendered for /oauth?format= (see renderExport).
+	Export any `json:"export,omitempty"`
 }
 
+// OAuthData is a login or token result. IssuedAt is when a returned code was
+// captured; ExpiresIn/ExpiresAt then describe the code's expected lifetime,
+// and the tokens' lifetime after an exchange.
 type OAuthData struct {
-	Code string `json:"code"`
+	Code         string     `json:"code,omitempty"`
+	CodeVerifier string     `json:"code_verifier,omitempty"`
+	AccessToken  string     `json:"access_token,omitempty"`
+	RefreshToken string     `json:"refresh_token,omitempty"`
+	IDToken      string     `json:"id_token,omitempty"`
+	TokenType    string     `json:"token_type,omitempty"`
+	IssuedAt     *time.Time `json:"issued_at,omitempty"`
+	ExpiresIn    int        `json:"expires_in,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	// Claims are the verified id_token claims, present whenever an id_token is
+	// unless IDTokenUnverified is set.
+	Claims *IDTokenClaims `json:"claims,omitempty"`
+	// IDTokenUnverified marks tokens whose id_token could not be checked,
+	// because the signing keys could not be fetched or (on a refresh) the
+	// check failed. The tokens are returned anyway so none are lost.
+	IDTokenUnverified bool `json:"id_token_unverified,omitempty"`
+	// HomeAssistant is the outcome of pushing the code into a Home Assistant
+	// config flow, when a target is configured.
+	HomeAssistant *HomeAssistantResult `json:"home_assistant,omitempty"`
+	// Executor names the login strategy that produced the code.
+	Executor string `json:"executor,omitempty"`
 }
 
 type BrandConfig struct {
 	OAuthURL string                   `json:"oauth_url"`
 	Realm    string                   `json:"realm"`
 	Scheme   string                   `json:"scheme"`
+	Executor string                   `json:"executor,omitempty"`
 	Configs  map[string]CountryConfig `json:"configs"`
+	// Recaptcha marks logins that only a real browser gets through.
+	Recaptcha bool `json:"recaptcha,omitempty"`
 }
 
 type CountryConfig struct {
 	Locale       string `json:"locale"`
 	ClientID     string `json:"client_id"`
 	ClientSecret string `json:"client_secret"`
+	Executor     string `json:"executor,omitempty"`
+	Recaptcha    bool   `json:"recaptcha,omitempty"`
 }
 
 func newApplicationMux() *http.ServeMux {
@@ -60,12 +118,23 @@ func newApplicationMux() *http.ServeMux {
 	mux.HandleFunc("/configs", handleConfigs)
 	mux.HandleFunc("/geo", handleGeo)
 	mux.HandleFunc("/oauth", handleOAuth)
+	mux.HandleFunc("/token", handleToken)
+	mux.HandleFunc("/token/refresh", handleTokenRefresh)
+	mux.HandleFunc("GET /oauth/{requestID}/qr.png", handleQRPNG)
+	mux.HandleFunc("GET /oauth/{requestID}/qr.svg", handleQRSVG)
+	mux.HandleFunc("POST /oauth/{requestID}/input", handleOAuthInput)
+	mux.HandleFunc("POST /api/jobs", handleCreateJob)
+	mux.HandleFunc("GET /api/jobs/{id}", handleJobStatus)
+	mux.HandleFunc("DELETE /api/jobs/{id}", handleCancelJob)
+	mux.HandleFunc("GET /api/jobs/{id}/events", handleJobEvents)
 	return mux
 }
 
 func newMetricsMux(handler http.Handler) *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", handler)
+	mux.HandleFunc("GET /debug/requests/{requestID}/screenshot.png", handleFailureScreenshot)
+	mux.HandleFunc("GET /debug/requests/{requestID}/trace.har", handleFailureHAR)
 	return mux
 }
 
@@ -132,107 +201,253 @@ func refundIfExpired(clientIP, requestID string, err error) {
 
 func handleOAuth(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		sendError(w, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	priority, ok := requestPriority(w, r)
+	if !ok {
+		return
+	}
+	req, format, clientIP, ok := parseOAuthRequest(w, r)
+	if !ok {
+		return
+	}
+
+	// Generate request ID
+	requestID := uuid.New().String()
+
+	log.Printf("[%s] OAuth request from %s for user %s (%s/%s)", requestID, clientIP, req.Email, req.Brand, req.Country)
+
+	ctx := withGateClient(r.Context(), clientIP, priority)
+
+	// Check if client accepts SSE
+	if r.Header.Get("Accept") == "text/event-stream" {
+		handleOAuthSSE(ctx, w, req, requestID, clientIP, format)
+		return
+	}
+
+	data, err := performOAuth(ctx, req, requestID, nil, nil)
+	if err != nil {
+		refundIfExpired(clientIP, requestID, err)
+		log.Printf("[%s] OAuth failed: %s", requestID, err.Error())
+		sendError(w, errorCodeOf(err), err.Error())
+		return
+	}
+
+	log.Printf("[%s] OAuth successful", requestID)
+	export, _ := renderExport(format, req.Brand, req.Country, data)
+	sendSuccess(w, data, export)
+}
+
+// parseOAuthRequest validates a login request for /oauth and /api/jobs and
+// charges it to the client's rate limit. On failure it has already written
+// the error response.
+func parseOAuthRequest(w http.ResponseWriter, r *http.Request) (req OAuthRequest, format, clientIP string, ok bool) {
+	format = r.URL.Query().Get("format")
+	if !validExportFormat(format) {
+		sendError(w, codeInvalidRequest, "Unknown export format: "+format)
 		return
 	}
 
 	// Get client IP early for rate limiting
-	clientIP := getClientIP(r)
+	clientIP = getClientIP(r)
 
 	// Check rate limit
 	if !rateLimiter.isAllowed(clientIP) {
 		remaining := rateLimiter.remaining(clientIP)
 		log.Printf("Rate limit exceeded for %s (remaining: %d)", clientIP, remaining)
-		sendError(w, "Rate limit exceeded. Try again later.", http.StatusTooManyRequests)
+		sendError(w, codeRateLimited, "Rate limit exceeded. Try again later.")
 		return
 	}
 
-	var req OAuthRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		sendError(w, "Invalid request body", http.StatusBadRequest)
+		sendError(w, codeInvalidRequest, "Invalid request body")
 		return
 	}
 
 	if req.Brand == "" || req.Country == "" || req.Email == "" || req.Password == "" {
-		sendError(w, "All fields are required", http.StatusBadRequest)
+		sendError(w, codeInvalidRequest, "All fields are required")
 		return
 	}
 
-	// Generate request ID
-	requestID := uuid.New().String()
+	if req.HomeAssistant != nil {
+		if !haAllowUserTargets {
+			sendError(w, codeInvalidRequest, "Home Assistant targets in requests are disabled on this server")
+			return
+		}
+		if req.HomeAssistant.URL == "" || req.HomeAssistant.Token == "" {
+			sendError(w, codeInvalidRequest, "Home Assistant url and token are required")
+			return
+		}
+		if req.Exchange || req.PKCE {
+			// Home Assistant redeems the code itself, without a code_verifier.
+			sendError(w, codeInvalidRequest, "exchange and pkce cannot be combined with a Home Assistant push")
+			return
+		}
+	}
+	return req, format, clientIP, true
+}
 
-	log.Printf("[%s] OAuth request from %s for user %s (%s/%s)", requestID, clientIP, req.Email, req.Brand, req.Country)
+// handleToken redeems an authorization code obtained earlier (e.g. from /oauth
+// without "exchange") for tokens. It is a single back-channel call, so it is
+// not rate limited and never touches the browser.
+func handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
 
-	// Check if client accepts SSE
-	if r.Header.Get("Accept") == "text/event-stream" {
-		handleOAuthSSE(w, req, requestID, clientIP)
+	var req TokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, codeInvalidRequest, "Invalid request body")
+		return
+	}
+	if req.Brand == "" || req.Country == "" || req.Code == "" {
+		sendError(w, codeInvalidRequest, "All fields are required")
 		return
 	}
 
-	code, err := performOAuth(req, requestID, nil, nil)
+	brandConfig, countryConfig, err := lookupConfig(req.Brand, req.Country)
 	if err != nil {
-		refundIfExpired(clientIP, requestID, err)
-		log.Printf("[%s] OAuth failed: %s", requestID, err.Error())
-		sendError(w, err.Error(), http.StatusBadRequest)
+		sendError(w, errorCodeOf(err), err.Error())
 		return
 	}
 
-	log.Printf("[%s] OAuth successful", requestID)
-	sendSuccess(w, code)
+	data, err := exchangeCode(
+		r.Context(), tokenClient, brandConfig, countryConfig, redirectURIFor(brandConfig, req.Country), req.Code, req.CodeVerifier,
+	)
+	if err == nil {
+		err = verifyTokens(idTokenKeys, data, brandConfig, countryConfig, "")
+	}
+	if err != nil {
+		log.Printf("Token exchange failed for %s/%s: %v", req.Brand, req.Country, err)
+		sendError(w, codeTokenExchange, err.Error())
+		return
+	}
+	sendSuccess(w, data, nil)
 }
 
-func handleOAuthSSE(w http.ResponseWriter, req OAuthRequest, requestID, clientIP string) {
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		sendError(w, "SSE not supported", http.StatusInternalServerError)
+// handleTokenRefresh renews tokens with a refresh token. Like /token it is a
+// plain back-channel call that bypasses the browser, SessionGate and rate
+// limiter, so keeping a session alive never costs a full re-login.
+func handleTokenRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, codeMethodNotAllowed, "Method not allowed")
 		return
 	}
 
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, codeInvalidRequest, "Invalid request body")
+		return
+	}
+	if req.Brand == "" || req.Country == "" || req.RefreshToken == "" {
+		sendError(w, codeInvalidRequest, "All fields are required")
+		return
+	}
 
-	progress := func(step string) {
-		_, _ = fmt.Fprintf(w, "data: {\"type\":\"progress\",\"message\":\"%s\"}\n\n", step)
-		flusher.Flush()
+	brandConfig, countryConfig, err := lookupConfig(req.Brand, req.Country)
+	if err != nil {
+		sendError(w, errorCodeOf(err), err.Error())
+		return
 	}
 
+	data, err := refreshTokens(r.Context(), tokenClient, brandConfig, countryConfig, req.RefreshToken)
+	if err != nil {
+		log.Printf("Token refresh failed for %s/%s: %v", req.Brand, req.Country, err)
+		sendError(w, codeTokenExchange, err.Error())
+		return
+	}
+	// ForgeRock may have rotated the refresh token, invalidating the one sent
+	// in, so the new tokens are returned even if their id_token fails the check.
+	if err := verifyTokens(idTokenKeys, data, brandConfig, countryConfig, ""); err != nil {
+		log.Printf("Token refresh for %s/%s returned an unverified id_token: %v", req.Brand, req.Country, err)
+		data.IDTokenUnverified = true
+	}
+	sendSuccess(w, data, nil)
+}
+
+func handleOAuthSSE(ctx context.Context, w http.ResponseWriter, req OAuthRequest, requestID, clientIP, format string) {
+	stream, ok := startSSE(w)
+	if !ok {
+		return
+	}
+	defer stream.keepAlive(ctx)()
+	streamOAuth(ctx, req, requestID, clientIP, format, stream.emit)
+}
+
+// streamOAuth runs a login whose progress is streamed, over SSE or into a job.
+// emit receives each event as its type and JSON payload; it is called from
+// several goroutines. The last event is success or error.
+func streamOAuth(
+	ctx context.Context,
+	req OAuthRequest,
+	requestID, clientIP, format string,
+	emit func(eventType string, payload []byte),
+) (*OAuthData, any, error) {
+	send := func(ev streamEvent) {
+		payload, _ := json.Marshal(ev)
+		emit(ev.kind(), payload)
+	}
+	progress := func(step string) {
+		send(progressEvent{eventHeader{eventProgress}, step})
+	}
 	debug := func(msg string) {
-		// Escape quotes for JSON
-		escaped := strings.ReplaceAll(msg, "\"", "\\\"")
-		_, _ = fmt.Fprintf(w, "data: {\"type\":\"debug\",\"message\":\"%s\"}\n\n", escaped)
-		flusher.Flush()
+		send(debugEvent{eventHeader{eventDebug}, msg})
 	}
+	ctx = withLoginTrace(ctx, &loginTrace{
+		phase: func(phase string, elapsed time.Duration) {
+			send(phaseEvent{eventHeader{eventPhase}, phase, int(elapsed.Seconds())})
+		},
+		queue: func(status QueueStatus) {
+			send(queueEvent{eventHeader{eventQueue}, status.String(), status.Position, etaSeconds(status.ETA)})
+		},
+	})
 
-	code, err := performOAuth(req, requestID, progress, debug)
+	// A login that hits a verification-code screen prompts through this
+	// stream; the answer comes back on POST /oauth/{requestID}/input.
+	closeInput := inputs.open(requestID, func(prompt string) {
+		send(inputRequiredEvent{eventHeader{eventInputRequired}, prompt, inputURL(requestID)})
+	})
+	defer closeInput()
+
+	data, err := performOAuth(ctx, req, requestID, progress, debug)
 	if err != nil {
 		refundIfExpired(clientIP, requestID, err)
 		log.Printf("[%s] OAuth failed: %s", requestID, err.Error())
-		_, _ = fmt.Fprintf(w, "data: {\"type\":\"error\",\"message\":\"%s\"}\n\n", err.Error())
-		flusher.Flush()
-		return
+		send(errorEvent{eventHeader{eventError}, err.Error(), errorCodeOf(err)})
+		return nil, nil, err
 	}
 
 	log.Printf("[%s] OAuth successful", requestID)
-	_, _ = fmt.Fprintf(w, "data: {\"type\":\"success\",\"code\":\"%s\"}\n\n", code)
-	flusher.Flush()
+	export, _ := renderExport(format, req.Brand, req.Country, data)
+	// Offer a QR code for a plain code so it can be scanned on a phone. Tokens
+	// and PKCE codes (useless without the verifier) are not put in a QR code.
+	var qr string
+	if data.Code != "" && data.AccessToken == "" && data.CodeVerifier == "" {
+		qrCodes.put(requestID, data.Code)
+		qr = qrURL(requestID)
+	}
+	send(successEvent{eventHeader{eventSuccess}, data, export, qr})
+	return data, export, nil
 }
 
-func sendError(w http.ResponseWriter, message string, statusCode int) {
+// sendError writes an error response with the HTTP status of code.
+func sendError(w http.ResponseWriter, code errorCode, message string) {
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
+	w.WriteHeader(code.status())
 	_ = json.NewEncoder(w).Encode(OAuthResponse{
-		Status:  "error",
-		Message: message,
+		Status:    "error",
+		ErrorCode: code,
+		Message:   message,
 	})
 }
 
-func sendSuccess(w http.ResponseWriter, code string) {
+func sendSuccess(w http.ResponseWriter, data *OAuthData, export any) {
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(OAuthResponse{
 		Status: "success",
-		Data: &OAuthData{
-			Code: code,
-		},
+		Data:   data,
+		Export: export,
 	})
 }
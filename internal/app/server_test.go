@@ -188,3 +188,28 @@ func TestParseClientIP(t *testing.T) {
 		}
 	}
 }
+
+func TestHandleOAuth_UnknownExportFormat(t *testing.T) {
+	body := `{"brand":"MyPeugeot","country":"DE","email":"a@b.c","password":"x"}`
+	req := httptest.NewRequest(http.MethodPost, "/oauth?format=yaml", strings.NewReader(body))
+	w := httptest.NewRecorder()
+
+	handleOAuth(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", w.Code)
+	}
+}
+
+func TestHandleOAuth_UserHomeAssistantTargetDisabled(t *testing.T) {
+	body := `{"brand":"MyPeugeot","country":"DE","email":"a@b.c","password":"x",` +
+		`"home_assistant":{"url":"http://10.0.0.1:8123","token":"t"}}`
+	req := httptest.NewRequest(http.MethodPost, "/oauth", strings.NewReader(body))
+	w := httptest.NewRecorder()
+
+	handleOAuth(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", w.Code)
+	}
+}
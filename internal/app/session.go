@@ -3,17 +3,109 @@ package app
 import (
 	"context"
 	"errors"
+	"fmt"
+	"slices"
+	"sync"
 	"time"
 )
 
 // ErrSessionBusy is returned when no browser session frees up within the wait timeout.
 var ErrSessionBusy = errors.New("all browser sessions are busy")
 
+// ErrQueueFull is returned when the SessionGate queue already holds its
+// maximum number of waiting requests.
+var ErrQueueFull = errors.New("too many logins are waiting for a browser session")
+
+// sessionHistory is how many recent session durations the queue ETA is
+// estimated from.
+const sessionHistory = 20
+
+// defaultPriorityBurst is how many API requests in a row may go before a
+// waiting web request.
+const defaultPriorityBurst = 3
+
+// queueUpdateInterval is how often a waiting request is told its refreshed
+// estimate when its position has not changed.
+var queueUpdateInterval = 5 * time.Second
+
+// gatePriority is the lane a request queues in at the SessionGate.
+type gatePriority int
+
+const (
+	priorityWeb gatePriority = iota // anonymous requests, e.g. from the web UI
+	priorityAPI                     // requests with a valid API key
+)
+
 // SessionGate bounds concurrent browser sessions. CloakBrowser's free tier
-// allows a single concurrent session, so the default capacity is 1.
+// allows a single concurrent session, so the default capacity is 1. Requests
+// that find every slot taken queue, and a freed slot is handed to the next of
+// them. API requests go before web requests, except that after maxBurst API
+// requests in a row a waiting web request gets the slot (maxBurst 0 always
+// prefers API requests). Within a lane they are served in arrival order, or
+// with fair set, round-robin across clients (see withGateClient) so one client
+// cannot crowd out the others.
 type SessionGate struct {
-	slots       chan struct{}
+	mu          sync.Mutex
+	capacity    int
+	started     []time.Time     // start of every session in use, oldest first
+	lanes       [2]gateLane     // indexed by gatePriority
+	burst       int             // API requests served in a row while web requests waited
+	recent      []time.Duration // durations of the last sessionHistory sessions
 	waitTimeout time.Duration
+	fair        bool
+	maxQueue    int // 0 is unbounded
+	maxBurst    int
+}
+
+// gateLane is the queue of one priority: each client's requests in arrival
+// order, served by taking turns between clients.
+type gateLane struct {
+	queues map[string][]*gateWaiter
+	turns  []string // clients with queued requests, next to be served first
+	queued int
+}
+
+// gateWaiter is a queued Acquire. granted is closed when it is handed a slot;
+// moved is signalled when its position may have changed.
+type gateWaiter struct {
+	client   string
+	priority gatePriority
+	granted  chan struct{}
+	moved    chan struct{}
+}
+
+// gateClient is whom a login is for: the client IP and its lane.
+type gateClient struct {
+	id       string
+	priority gatePriority
+}
+
+type gateClientKey struct{}
+
+// withGateClient tags ctx with the client (its IP) a login is for and the
+// lane it queues in at the SessionGate.
+func withGateClient(ctx context.Context, client string, priority gatePriority) context.Context {
+	return context.WithValue(ctx, gateClientKey{}, gateClient{id: client, priority: priority})
+}
+
+// QueueStatus is a waiting request's place in the SessionGate queue.
+type QueueStatus struct {
+	Position int           // 1 is next in line
+	ETA      time.Duration // estimated wait, 0 before any session has finished
+}
+
+// String describes s for progress messages, e.g. "Queued, position 3, ~90s".
+func (s QueueStatus) String() string {
+	msg := fmt.Sprintf("Queued, position %d", s.Position)
+	if s.ETA > 0 {
+		msg += fmt.Sprintf(", ~%ds", etaSeconds(s.ETA))
+	}
+	return msg
+}
+
+// etaSeconds rounds an estimate up to whole seconds.
+func etaSeconds(eta time.Duration) int {
+	return int((eta + time.Second - 1) / time.Second)
 }
 
 func newSessionGate(maxSessions int, waitTimeout time.Duration) *SessionGate {
@@ -21,42 +113,301 @@ func newSessionGate(maxSessions int, waitTimeout time.Duration) *SessionGate {
 		maxSessions = 1
 	}
 	return &SessionGate{
-		slots:       make(chan struct{}, maxSessions),
+		capacity:    maxSessions,
+		lanes:       [2]gateLane{{queues: make(map[string][]*gateWaiter)}, {queues: make(map[string][]*gateWaiter)}},
 		waitTimeout: waitTimeout,
+		maxBurst:    defaultPriorityBurst,
 	}
 }
 
 // Acquire reserves a session slot. If one is free it returns immediately.
-// Otherwise onWait (if non-nil) is invoked once and the call blocks until a
-// slot frees up, the wait timeout elapses (ErrSessionBusy), or ctx is done.
-func (g *SessionGate) Acquire(ctx context.Context, onWait func()) error {
-	select {
-	case g.slots <- struct{}{}:
+// Otherwise the call queues and blocks until a slot is handed to it, the wait
+// timeout elapses (ErrSessionBusy), or ctx is done; a full queue fails at once
+// with ErrQueueFull. While queued, onWait (if non-nil) is told the request's
+// position and estimated wait: on arrival, whenever the position changes and
+// every queueUpdateInterval.
+func (g *SessionGate) Acquire(ctx context.Context, onWait func(QueueStatus)) error {
+	g.mu.Lock()
+	if len(g.started) < g.capacity && g.queued() == 0 {
+		g.started = append(g.started, time.Now())
+		g.mu.Unlock()
 		return nil
-	default:
 	}
-
-	if onWait != nil {
-		onWait()
+	if g.maxQueue > 0 && g.queued() >= g.maxQueue {
+		g.mu.Unlock()
+		return ErrQueueFull
+	}
+	client, _ := ctx.Value(gateClientKey{}).(gateClient)
+	w := &gateWaiter{priority: client.priority, granted: make(chan struct{}), moved: make(chan struct{}, 1)}
+	if g.fair {
+		w.client = client.id
 	}
+	g.lanes[w.priority].enqueue(w)
+	g.mu.Unlock()
 
 	timer := time.NewTimer(g.waitTimeout)
 	defer timer.Stop()
+	ticker := time.NewTicker(queueUpdateInterval)
+	defer ticker.Stop()
 
-	select {
-	case g.slots <- struct{}{}:
-		return nil
-	case <-timer.C:
-		return ErrSessionBusy
-	case <-ctx.Done():
-		return ctx.Err()
+	report := func() {
+		if status, ok := g.status(w); ok && onWait != nil {
+			onWait(status)
+		}
+	}
+	report()
+	for {
+		select {
+		case <-w.granted:
+			return nil
+		case <-w.moved:
+			report()
+		case <-ticker.C:
+			report()
+		case <-timer.C:
+			if g.leave(w) {
+				return ErrSessionBusy
+			}
+			return nil // handed a slot just in time
+		case <-ctx.Done():
+			if !g.leave(w) {
+				g.Release()
+			}
+			return ctx.Err()
+		}
 	}
 }
 
-// Release returns a previously acquired slot. Safe to call at most once per Acquire.
+// Release returns a previously acquired slot, handing it to the first queued
+// request if there is one. Safe to call at most once per Acquire.
 func (g *SessionGate) Release() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.started) == 0 {
+		return
+	}
+	// Sessions are assumed to end in the order they started; with a single
+	// slot (the default) that is exact.
+	g.recent = append(g.recent, time.Since(g.started[0]))
+	if len(g.recent) > sessionHistory {
+		g.recent = g.recent[1:]
+	}
+	g.started = g.started[1:]
+
+	if g.queued() == 0 {
+		return
+	}
+	next := g.dequeue()
+	g.started = append(g.started, time.Now())
+	close(next.granted)
+	g.notifyMoved()
+}
+
+// queued counts the requests in both lanes. The caller holds g.mu.
+func (g *SessionGate) queued() int {
+	return g.lanes[priorityWeb].queued + g.lanes[priorityAPI].queued
+}
+
+// dequeue removes and returns the next request. The caller holds g.mu and has
+// checked that a request is queued.
+func (g *SessionGate) dequeue() *gateWaiter {
+	api, web := &g.lanes[priorityAPI], &g.lanes[priorityWeb]
+	if g.apiGoesNext(api.queued > 0, web.queued > 0, g.burst) {
+		if web.queued > 0 {
+			g.burst++
+		}
+		return api.dequeue()
+	}
+	g.burst = 0
+	return web.dequeue()
+}
+
+// apiGoesNext reports whether an API request is served before a web request,
+// given burst API requests have just been served while web requests waited.
+func (g *SessionGate) apiGoesNext(apiWaiting, webWaiting bool, burst int) bool {
+	return apiWaiting && (!webWaiting || g.maxBurst <= 0 || burst < g.maxBurst)
+}
+
+// leave takes w out of the queue. It reports false when w was already handed
+// a slot, which the caller then holds.
+func (g *SessionGate) leave(w *gateWaiter) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.lanes[w.priority].remove(w) {
+		return false
+	}
+	if g.lanes[priorityWeb].queued == 0 {
+		g.burst = 0
+	}
+	g.notifyMoved()
+	return true
+}
+
+// notifyMoved tells every waiter its position may have changed. The caller
+// holds g.mu.
+func (g *SessionGate) notifyMoved() {
+	for _, lane := range g.lanes {
+		for _, queue := range lane.queues {
+			for _, w := range queue {
+				w.signal()
+			}
+		}
+	}
+}
+
+func (w *gateWaiter) signal() {
 	select {
-	case <-g.slots:
+	case w.moved <- struct{}{}:
 	default:
 	}
 }
+
+// order returns the queued requests in the order they will be served. The
+// caller holds g.mu.
+func (g *SessionGate) order() []*gateWaiter {
+	api, web := g.lanes[priorityAPI].order(), g.lanes[priorityWeb].order()
+	out := make([]*gateWaiter, 0, len(api)+len(web))
+	burst := g.burst
+	for len(api) > 0 || len(web) > 0 {
+		if g.apiGoesNext(len(api) > 0, len(web) > 0, burst) {
+			if len(web) > 0 {
+				burst++
+			}
+			out, api = append(out, api[0]), api[1:]
+		} else {
+			burst = 0
+			out, web = append(out, web[0]), web[1:]
+		}
+	}
+	return out
+}
+
+// enqueue adds w behind the other requests of its client. A client without
+// queued requests takes the last turn.
+func (l *gateLane) enqueue(w *gateWaiter) {
+	if len(l.queues[w.client]) == 0 {
+		l.turns = append(l.turns, w.client)
+	}
+	l.queues[w.client] = append(l.queues[w.client], w)
+	l.queued++
+}
+
+// dequeue removes and returns the first request of the client whose turn it
+// is, which then goes to the back of the turns if it has more. Without fair,
+// every request has the same client and this is plain FIFO.
+func (l *gateLane) dequeue() *gateWaiter {
+	client := l.turns[0]
+	l.turns = l.turns[1:]
+	queue := l.queues[client]
+	next := queue[0]
+	if len(queue) > 1 {
+		l.queues[client] = queue[1:]
+		l.turns = append(l.turns, client)
+	} else {
+		delete(l.queues, client)
+	}
+	l.queued--
+	return next
+}
+
+// remove takes w out of the lane, reporting whether it was queued there.
+func (l *gateLane) remove(w *gateWaiter) bool {
+	queue := l.queues[w.client]
+	i := slices.Index(queue, w)
+	if i < 0 {
+		return false
+	}
+	if len(queue) == 1 {
+		delete(l.queues, w.client)
+		l.turns = slices.DeleteFunc(l.turns, func(c string) bool { return c == w.client })
+	} else {
+		l.queues[w.client] = slices.Delete(queue, i, i+1)
+	}
+	l.queued--
+	return true
+}
+
+// order returns the lane's requests in the order they will be served.
+func (l *gateLane) order() []*gateWaiter {
+	turns := slices.Clone(l.turns)
+	served := make(map[string]int, len(l.queues))
+	out := make([]*gateWaiter, 0, l.queued)
+	for len(turns) > 0 {
+		client := turns[0]
+		turns = turns[1:]
+		queue := l.queues[client]
+		out = append(out, queue[served[client]])
+		served[client]++
+		if served[client] < len(queue) {
+			turns = append(turns, client)
+		}
+	}
+	return out
+}
+
+// status returns w's place in the queue, or false once it left it.
+func (g *SessionGate) status(w *gateWaiter) (QueueStatus, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	i := slices.Index(g.order(), w)
+	if i < 0 {
+		return QueueStatus{}, false
+	}
+	return QueueStatus{Position: i + 1, ETA: g.estimate(i + 1)}, true
+}
+
+// estimate predicts when the request at position gets a slot: each session in
+// use is expected to last the average of the recent ones, and each slot then
+// serves the queue in turn. The caller holds g.mu.
+func (g *SessionGate) estimate(position int) time.Duration {
+	if len(g.recent) == 0 {
+		return 0
+	}
+	var total time.Duration
+	for _, d := range g.recent {
+		total += d
+	}
+	avg := total / time.Duration(len(g.recent))
+
+	// When each slot frees up next, counted from now.
+	free := make([]time.Duration, g.capacity)
+	for i, start := range g.started {
+		free[i] = max(avg-time.Since(start), 0)
+	}
+	for {
+		slices.Sort(free)
+		if position == 1 {
+			return free[0]
+		}
+		free[0] += avg
+		position--
+	}
+}
+
+// sessionLease holds a gate slot for the whole of one /oauth request, so a
+// retry after an expired Stellantis session keeps the slot instead of queueing
+// behind other requests again. It belongs to a single request goroutine.
+type sessionLease struct {
+	gate *SessionGate
+	held bool
+}
+
+// acquire reserves a slot unless the lease already holds one.
+func (l *sessionLease) acquire(ctx context.Context, onWait func(QueueStatus)) error {
+	if l.held {
+		return nil
+	}
+	if err := l.gate.Acquire(ctx, onWait); err != nil {
+		return err
+	}
+	l.held = true
+	return nil
+}
+
+// release gives the slot back, if held. Safe to call repeatedly.
+func (l *sessionLease) release() {
+	if l.held {
+		l.gate.Release()
+		l.held = false
+	}
+}
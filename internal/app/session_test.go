@@ -2,6 +2,8 @@ package app
 
 import (
 	"context"
+	"errors"
+	"strings"
 	"testing"
 	"time"
 )
@@ -9,7 +11,7 @@ import (
 func TestSessionGate_AcquireImmediateNoWait(t *testing.T) {
 	g := newSessionGate(1, time.Second)
 	waited := false
-	if err := g.Acquire(context.Background(), func() { waited = true }); err != nil {
+	if err := g.Acquire(context.Background(), func(QueueStatus) { waited = true }); err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 	if waited {
@@ -24,7 +26,7 @@ func TestSessionGate_SecondCallWaitsThenTimesOut(t *testing.T) {
 		t.Fatalf("first acquire failed: %v", err)
 	}
 	waited := false
-	err := g.Acquire(context.Background(), func() { waited = true })
+	err := g.Acquire(context.Background(), func(QueueStatus) { waited = true })
 	if err != ErrSessionBusy {
 		t.Fatalf("expected ErrSessionBusy, got %v", err)
 	}
@@ -46,3 +48,240 @@ func TestSessionGate_ReleaseLetsNextAcquire(t *testing.T) {
 	}
 	g.Release()
 }
+
+func TestSessionLease_HoldsSlotAcrossAcquires(t *testing.T) {
+	g := newSessionGate(1, 20*time.Millisecond)
+	lease := &sessionLease{gate: g}
+	for i := 0; i < 2; i++ {
+		if err := lease.acquire(context.Background(), nil); err != nil {
+			t.Fatalf("acquire #%d: %v", i+1, err)
+		}
+	}
+	if err := g.Acquire(context.Background(), nil); err != ErrSessionBusy {
+		t.Fatalf("other request got the leased slot: %v", err)
+	}
+
+	lease.release()
+	lease.release()
+	if err := g.Acquire(context.Background(), nil); err != nil {
+		t.Fatalf("slot not freed by release: %v", err)
+	}
+	g.Release()
+}
+
+func TestSessionGate_QueuesInOrderAndReportsPosition(t *testing.T) {
+	g := newSessionGate(1, time.Second)
+	_ = g.Acquire(context.Background(), nil)
+
+	type update struct {
+		waiter string
+		status QueueStatus
+	}
+	updates := make(chan update, 16)
+	granted := make(chan string, 2)
+	wait := func(name string) {
+		err := g.Acquire(context.Background(), func(s QueueStatus) { updates <- update{name, s} })
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		granted <- name
+	}
+	go wait("first")
+	if u := <-updates; u.waiter != "first" || u.status.Position != 1 {
+		t.Fatalf("update = %+v, want first at position 1", u)
+	}
+	go wait("second")
+	if u := <-updates; u.waiter != "second" || u.status.Position != 2 {
+		t.Fatalf("update = %+v, want second at position 2", u)
+	}
+
+	g.Release()
+	if name := <-granted; name != "first" {
+		t.Fatalf("%s got the slot before first", name)
+	}
+	if u := <-updates; u.waiter != "second" || u.status.Position != 1 {
+		t.Errorf("update = %+v, want second moved to position 1", u)
+	}
+	g.Release()
+	<-granted
+	g.Release()
+}
+
+func TestSessionGate_CanceledWaiterLeavesQueue(t *testing.T) {
+	g := newSessionGate(1, time.Second)
+	_ = g.Acquire(context.Background(), nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	queued := make(chan struct{}, 1)
+	done := make(chan error)
+	go func() {
+		done <- g.Acquire(ctx, func(QueueStatus) { queued <- struct{}{} })
+	}()
+	<-queued
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("Acquire() error = %v, want context.Canceled", err)
+	}
+
+	g.Release()
+	if err := g.Acquire(context.Background(), nil); err != nil {
+		t.Fatalf("slot not free after the only waiter left: %v", err)
+	}
+	g.Release()
+}
+
+func TestSessionGate_EstimateFromRecentSessions(t *testing.T) {
+	g := newSessionGate(1, time.Second)
+	if eta := g.estimate(1); eta != 0 {
+		t.Errorf("estimate without history = %v, want 0", eta)
+	}
+
+	g.recent = []time.Duration{30 * time.Second, 60 * time.Second}
+	g.started = []time.Time{time.Now().Add(-15 * time.Second)}
+	// The session in use has ~30s of its 45s average left; each request ahead
+	// adds another 45s.
+	for position, want := range map[int]time.Duration{1: 30 * time.Second, 3: 120 * time.Second} {
+		if eta := g.estimate(position); eta < want-time.Second || eta > want {
+			t.Errorf("estimate(%d) = %v, want ~%v", position, eta, want)
+		}
+	}
+}
+
+func TestQueueStatusString(t *testing.T) {
+	if got := (QueueStatus{Position: 3, ETA: 89500 * time.Millisecond}).String(); got != "Queued, position 3, ~90s" {
+		t.Errorf("String() = %q", got)
+	}
+	if got := (QueueStatus{Position: 1}).String(); got != "Queued, position 1" {
+		t.Errorf("String() without estimate = %q", got)
+	}
+}
+
+// queueWaiters queues one web Acquire per client, in order, and returns the
+// order in which they are granted as the held slot is passed on.
+func queueWaiters(t *testing.T, g *SessionGate, clients ...string) []string {
+	t.Helper()
+	gateClients := make([]gateClient, len(clients))
+	for i, client := range clients {
+		gateClients[i] = gateClient{id: client, priority: priorityWeb}
+	}
+	return queueClients(t, g, gateClients...)
+}
+
+// queueClients is queueWaiters for clients of any priority.
+func queueClients(t *testing.T, g *SessionGate, clients ...gateClient) []string {
+	t.Helper()
+	granted := make(chan string, len(clients))
+	for _, client := range clients {
+		queued := make(chan struct{}, 1)
+		go func() {
+			ctx := withGateClient(context.Background(), client.id, client.priority)
+			err := g.Acquire(ctx, func(QueueStatus) {
+				select {
+				case queued <- struct{}{}:
+				default:
+				}
+			})
+			if err != nil {
+				t.Errorf("%s: %v", client.id, err)
+			}
+			granted <- client.id
+		}()
+		<-queued
+	}
+	var order []string
+	for range clients {
+		g.Release()
+		order = append(order, <-granted)
+	}
+	g.Release()
+	return order
+}
+
+func TestSessionGate_FIFOByDefault(t *testing.T) {
+	g := newSessionGate(1, time.Second)
+	_ = g.Acquire(context.Background(), nil)
+
+	order := queueWaiters(t, g, "a", "a", "a", "b", "c")
+	if got := strings.Join(order, ","); got != "a,a,a,b,c" {
+		t.Errorf("grant order = %s, want arrival order", got)
+	}
+}
+
+func TestSessionGate_FairRoundRobinAcrossClients(t *testing.T) {
+	g := newSessionGate(1, time.Second)
+	g.fair = true
+	_ = g.Acquire(context.Background(), nil)
+
+	order := queueWaiters(t, g, "a", "a", "a", "b", "c")
+	if got := strings.Join(order, ","); got != "a,b,c,a,a" {
+		t.Errorf("grant order = %s, want a,b,c,a,a", got)
+	}
+}
+
+func TestSessionGate_FairPositionFollowsTurns(t *testing.T) {
+	g := newSessionGate(1, time.Second)
+	g.fair = true
+	_ = g.Acquire(context.Background(), nil)
+	defer g.Release()
+
+	positions := make(chan int, 8)
+	for _, client := range []string{"a", "a", "b"} {
+		arrived := make(chan struct{})
+		go func() {
+			ctx, cancel := context.WithTimeout(withGateClient(context.Background(), client, priorityWeb), 200*time.Millisecond)
+			defer cancel()
+			first := true
+			_ = g.Acquire(ctx, func(s QueueStatus) {
+				if first {
+					first = false
+					close(arrived)
+					if client == "b" {
+						positions <- s.Position
+					}
+				}
+			})
+		}()
+		<-arrived
+	}
+	// b arrived last but is served right after a's first request.
+	if pos := <-positions; pos != 2 {
+		t.Errorf("b position = %d, want 2", pos)
+	}
+}
+
+func TestSessionGate_QueueFull(t *testing.T) {
+	g := newSessionGate(1, time.Second)
+	g.maxQueue = 1
+	_ = g.Acquire(context.Background(), nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	queued := make(chan struct{}, 1)
+	done := make(chan error)
+	go func() { done <- g.Acquire(ctx, func(QueueStatus) { queued <- struct{}{} }) }()
+	<-queued
+
+	if err := g.Acquire(context.Background(), nil); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("Acquire() error = %v, want ErrQueueFull", err)
+	}
+	cancel()
+	<-done
+	g.Release()
+}
+
+func TestSessionGate_APIRequestsGoFirstWithStarvationGuard(t *testing.T) {
+	clients := []gateClient{
+		{"web1", priorityWeb}, {"web2", priorityWeb},
+		{"api1", priorityAPI}, {"api2", priorityAPI}, {"api3", priorityAPI}, {"api4", priorityAPI},
+	}
+	for burst, want := range map[int]string{
+		2: "api1,api2,web1,api3,api4,web2",
+		0: "api1,api2,api3,api4,web1,web2",
+	} {
+		g := newSessionGate(1, time.Second)
+		g.maxBurst = burst
+		_ = g.Acquire(context.Background(), nil)
+
+		if got := strings.Join(queueClients(t, g, clients...), ","); got != want {
+			t.Errorf("maxBurst %d: grant order = %s, want %s", burst, got, want)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// sseRetry is the reconnection delay suggested to clients in the retry: field.
+const sseRetry = 3 * time.Second
+
+// sseKeepalive is how often a stream gets a comment line, so proxies do not
+// close it while a login waits for a slot or a page.
+var sseKeepalive = 15 * time.Second
+
+// Types of the events of a streamed login, sent as the SSE event: field and
+// as "type" in the JSON data.
+const (
+	eventProgress      = "progress"
+	eventPhase         = "phase"
+	eventQueue         = "queue"
+	eventDebug         = "debug"
+	eventInputRequired = "input_required"
+	eventSuccess       = "success"
+	eventError         = "error"
+)
+
+// streamEvent is an event of a streamed login (POST /oauth over SSE and the
+// job event streams). The events below are its JSON schema; see the README.
+type streamEvent interface {
+	kind() string
+}
+
+// eventHeader carries the type of an event in its JSON.
+type eventHeader struct {
+	Type string `json:"type"`
+}
+
+func (h eventHeader) kind() string { return h.Type }
+
+// progressEvent is a human-readable status line.
+type progressEvent struct {
+	eventHeader
+	Message string `json:"message"`
+}
+
+// phaseEvent reports that the browser login entered a new phase.
+type phaseEvent struct {
+	eventHeader
+	Phase          string `json:"phase"`
+	ElapsedSeconds int    `json:"elapsed_seconds"`
+}
+
+// queueEvent reports that the login waits for a free browser session, and
+// where it stands in the queue. ETASeconds is 0 until an estimate exists.
+type queueEvent struct {
+	eventHeader
+	Message    string `json:"message"`
+	Position   int    `json:"position"`
+	ETASeconds int    `json:"eta_seconds"`
+}
+
+// debugEvent is a URL the browser fetched during the login.
+type debugEvent struct {
+	eventHeader
+	Message string `json:"message"`
+}
+
+// inputRequiredEvent asks for a verification code (see handleOAuthInput).
+type inputRequiredEvent struct {
+	eventHeader
+	Prompt   string `json:"prompt"`
+	InputURL string `json:"input_url"`
+}
+
+// errorEvent ends a failed login.
+type errorEvent struct {
+	eventHeader
+	Message   string    `json:"message"`
+	ErrorCode errorCode `json:"error_code"`
+}
+
+// successEvent ends a successful login with its result.
+type successEvent struct {
+	eventHeader
+	*OAuthData
+	Export any    `json:"export,omitempty"`
+	QRURL  string `json:"qr_url,omitempty"`
+}
+
+// sseStream writes Server-Sent Events with sequential IDs. Writes come from
+// the login goroutine, its heartbeat, the input prompt and the keepalive, so
+// they are serialized.
+type sseStream struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	flusher http.Flusher
+	lastID  int
+}
+
+// startSSE sends the stream headers and the retry hint. It writes an error
+// response instead when w cannot stream.
+func startSSE(w http.ResponseWriter) (*sseStream, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		sendError(w, codeInternal, "SSE not supported")
+		return nil, false
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	s := &sseStream{w: w, flusher: flusher}
+	s.write("retry: %d\n\n", sseRetry.Milliseconds())
+	return s, true
+}
+
+// emit sends an event with the next ID; it is streamOAuth's emit. payload is
+// JSON, so it never spans lines.
+func (s *sseStream) emit(eventType string, payload []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastID++
+	s.writeLocked("id: %d\nevent: %s\ndata: %s\n\n", s.lastID, eventType, payload)
+}
+
+// resumeAfter numbers the following events from id+1.
+func (s *sseStream) resumeAfter(id int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastID = id
+}
+
+// keepAlive writes a comment every sseKeepalive until ctx is done or the
+// returned stop is called.
+func (s *sseStream) keepAlive(ctx context.Context) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(sseKeepalive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.write(": keepalive\n\n")
+			}
+		}
+	}()
+	return func() { cancel(); <-done }
+}
+
+func (s *sseStream) write(format string, args ...any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeLocked(format, args...)
+}
+
+func (s *sseStream) writeLocked(format string, args ...any) {
+	_, _ = fmt.Fprintf(s.w, format, args...)
+	s.flusher.Flush()
+}
@@ -0,0 +1,73 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSSEStreamEventFormat(t *testing.T) {
+	w := httptest.NewRecorder()
+	stream, ok := startSSE(w)
+	if !ok {
+		t.Fatal("startSSE() failed")
+	}
+	msg := "C:\\path \"quoted\"\nsecond line"
+	payload, _ := json.Marshal(progressEvent{eventHeader{eventProgress}, msg})
+	stream.emit(eventProgress, payload)
+	stream.resumeAfter(41)
+	stream.emit(eventDebug, []byte(`{}`))
+
+	body := w.Body.String()
+	if !strings.HasPrefix(body, "retry: 3000\n\n") {
+		t.Errorf("stream does not start with the retry hint: %q", body)
+	}
+	events := strings.Split(strings.TrimPrefix(body, "retry: 3000\n\n"), "\n\n")
+	lines := strings.Split(events[0], "\n")
+	if len(lines) != 3 || lines[0] != "id: 1" || lines[1] != "event: progress" {
+		t.Fatalf("event = %q, want id, event and a single data line", events[0])
+	}
+	var ev progressEvent
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), &ev); err != nil {
+		t.Fatalf("data is not JSON: %v", err)
+	}
+	if ev.Type != eventProgress || ev.Message != msg {
+		t.Errorf("event = %+v, want the message back", ev)
+	}
+	if !strings.HasPrefix(events[1], "id: 42\nevent: debug\n") {
+		t.Errorf("resumed event = %q, want id 42", events[1])
+	}
+}
+
+func TestSSEStreamKeepAlive(t *testing.T) {
+	orig := sseKeepalive
+	sseKeepalive = 5 * time.Millisecond
+	t.Cleanup(func() { sseKeepalive = orig })
+
+	w := httptest.NewRecorder()
+	stream, _ := startSSE(w)
+	stop := stream.keepAlive(t.Context())
+	time.Sleep(30 * time.Millisecond)
+	stop()
+
+	if !strings.Contains(w.Body.String(), "\n: keepalive\n\n") {
+		t.Errorf("no keepalive comment in %q", w.Body.String())
+	}
+}
+
+func TestStartProgressHeartbeatReportsPhaseChanges(t *testing.T) {
+	var phases []string
+	setPhase, stop := startProgressHeartbeat(nil, func(phase string, _ time.Duration) {
+		phases = append(phases, phase)
+	})
+	setPhase("Logging in")
+	setPhase("Logging in")
+	setPhase("Authorizing")
+	stop()
+
+	if got := strings.Join(phases, ","); got != "Starting browser,Logging in,Authorizing" {
+		t.Errorf("phases = %s", got)
+	}
+}
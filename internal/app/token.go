@@ -0,0 +1,125 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// tokenPath is the ForgeRock AM token endpoint, relative to a brand's oauth_url.
+const tokenPath = "/am/oauth2/access_token"
+
+// tokenClient talks to the ForgeRock token endpoint. Token grants are plain
+// back-channel HTTP calls, so they need neither the browser nor the SessionGate.
+var tokenClient = &http.Client{Timeout: 20 * time.Second}
+
+// tokenResponse is the subset of the ForgeRock token response we consume,
+// including the RFC 6749 error fields returned on a failed grant.
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	RefreshToken     string `json:"refresh_token"`
+	IDToken          string `json:"id_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int    `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// exchangeCode trades an authorization code for tokens. redirectURI must match
+// the one used in the authorization request or ForgeRock rejects the grant;
+// codeVerifier is required when the request carried a PKCE challenge.
+func exchangeCode(
+	ctx context.Context, client *http.Client, brand BrandConfig, country CountryConfig, redirectURI, code, codeVerifier string,
+) (*OAuthData, error) {
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {redirectURI},
+	}
+	if codeVerifier != "" {
+		form.Set("code_verifier", codeVerifier)
+	}
+	data, err := requestTokens(ctx, client, brand, country, form)
+	if err != nil {
+		return nil, err
+	}
+	data.Code = code
+	return data, nil
+}
+
+// refreshTokens performs the refresh-token grant. ForgeRock may rotate the
+// refresh token; when it does not return a new one the old one stays valid and
+// is echoed back so callers can always store data.RefreshToken.
+func refreshTokens(ctx context.Context, client *http.Client, brand BrandConfig, country CountryConfig, refreshToken string) (*OAuthData, error) {
+	data, err := requestTokens(ctx, client, brand, country, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if data.RefreshToken == "" {
+		data.RefreshToken = refreshToken
+	}
+	return data, nil
+}
+
+// requestTokens POSTs a grant to the brand's token endpoint, authenticating
+// with the country's client credentials via HTTP Basic (as the Stellantis apps
+// do), and returns the issued tokens.
+func requestTokens(ctx context.Context, client *http.Client, brand BrandConfig, country CountryConfig, form url.Values) (*OAuthData, error) {
+	endpoint := strings.TrimRight(brand.OAuthURL, "/") + tokenPath
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(country.ClientID, country.ClientSecret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token endpoint unreachable: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading token response: %w", err)
+	}
+
+	var tr tokenResponse
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return nil, fmt.Errorf("token endpoint returned status %d with an unparseable body", resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK || tr.Error != "" {
+		if tr.ErrorDescription != "" {
+			return nil, fmt.Errorf("token request rejected: %s (%s)", tr.ErrorDescription, tr.Error)
+		}
+		if tr.Error != "" {
+			return nil, fmt.Errorf("token request rejected: %s", tr.Error)
+		}
+		return nil, fmt.Errorf("token endpoint returned status %d", resp.StatusCode)
+	}
+	if tr.AccessToken == "" {
+		return nil, fmt.Errorf("token endpoint returned no access_token")
+	}
+
+	data := &OAuthData{
+		AccessToken:  tr.AccessToken,
+		RefreshToken: tr.RefreshToken,
+		IDToken:      tr.IDToken,
+		TokenType:    tr.TokenType,
+		ExpiresIn:    tr.ExpiresIn,
+	}
+	if tr.ExpiresIn > 0 {
+		expiresAt := time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second).UTC()
+		data.ExpiresAt = &expiresAt
+	}
+	return data, nil
+}
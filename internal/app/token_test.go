@@ -0,0 +1,320 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withTestConfigs points the embedded brand configs at a single MyPeugeot/DE
+// entry whose oauth_url is oauthURL, restoring the real configs afterwards.
+func withTestConfigs(t *testing.T, oauthURL string) {
+	t.Helper()
+	orig := configsJSON
+	configsJSON = []byte(`{
+		"MyPeugeot": {
+			"oauth_url": "` + oauthURL + `",
+			"scheme": "mymap",
+			"configs": {
+				"DE": {"locale": "de-DE", "client_id": "client-id", "client_secret": "client-secret"}
+			}
+		}
+	}`)
+	t.Cleanup(func() { configsJSON = orig })
+}
+
+// testIdP is a fake ForgeRock serving the token and JWKS endpoints.
+type testIdP struct {
+	*httptest.Server
+	// nonce is put into issued id_tokens; set it before the token request.
+	nonce string
+	// jwksDown makes the JWKS endpoint fail.
+	jwksDown bool
+}
+
+// newTestTokenServer serves the ForgeRock token endpoint, checking the client
+// credentials and passing the parsed form to check before answering with a
+// signed id_token. The JWKS endpoint publishes the signing key.
+func newTestTokenServer(t *testing.T, check func(form map[string]string)) *testIdP {
+	t.Helper()
+	key := testSigningKey(t)
+	idp := &testIdP{}
+	idp.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == jwksPath {
+			if idp.jwksDown {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			_, _ = w.Write(testJWKS(key))
+			return
+		}
+		if r.URL.Path != tokenPath {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		if id, secret, ok := r.BasicAuth(); !ok || id != "client-id" || secret != "client-secret" {
+			t.Errorf("client credentials = %q/%q (ok=%v)", id, secret, ok)
+		}
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("parse form: %v", err)
+			http.Error(w, "bad form", http.StatusBadRequest)
+			return
+		}
+		form := make(map[string]string)
+		for k := range r.PostForm {
+			form[k] = r.PostForm.Get(k)
+		}
+		check(form)
+
+		claims := validTestClaims(idp.URL)
+		claims["nonce"] = idp.nonce
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"access_token":  "at",
+			"refresh_token": "rt",
+			"id_token":      signTestIDToken(t, key, claims),
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+		})
+	}))
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func TestExchangeCode(t *testing.T) {
+	srv := newTestTokenServer(t, func(form map[string]string) {
+		if form["grant_type"] != "authorization_code" {
+			t.Errorf("grant_type = %q", form["grant_type"])
+		}
+		if form["code"] != "the-code" {
+			t.Errorf("code = %q", form["code"])
+		}
+		if form["redirect_uri"] != "mymap://oauth2redirect/de" {
+			t.Errorf("redirect_uri = %q", form["redirect_uri"])
+		}
+	})
+
+	brand := BrandConfig{OAuthURL: srv.URL, Scheme: "mymap"}
+	country := CountryConfig{ClientID: "client-id", ClientSecret: "client-secret"}
+	data, err := exchangeCode(context.Background(), srv.Client(), brand, country, redirectURIFor(brand, "DE"), "the-code", "")
+	if err != nil {
+		t.Fatalf("exchangeCode() error = %v", err)
+	}
+	if data.Code != "the-code" || data.AccessToken != "at" || data.RefreshToken != "rt" || data.IDToken == "" {
+		t.Errorf("unexpected tokens: %+v", data)
+	}
+	if data.ExpiresIn != 3600 || data.ExpiresAt == nil {
+		t.Errorf("expiry not populated: expires_in=%d expires_at=%v", data.ExpiresIn, data.ExpiresAt)
+	}
+}
+
+func TestRequestTokensRejected(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"invalid_grant","error_description":"The provided access grant is invalid"}`))
+	}))
+	defer srv.Close()
+
+	_, err := exchangeCode(context.Background(), srv.Client(), BrandConfig{OAuthURL: srv.URL}, CountryConfig{}, "mymap://x", "stale", "")
+	if err == nil {
+		t.Fatal("exchangeCode() error = nil, want rejection")
+	}
+	if !strings.Contains(err.Error(), "invalid_grant") || !strings.Contains(err.Error(), "access grant is invalid") {
+		t.Errorf("error = %q, want ForgeRock error details", err)
+	}
+}
+
+func TestPerformOAuthWithExecutorExchangesCode(t *testing.T) {
+	srv := newTestTokenServer(t, func(form map[string]string) {
+		if form["code"] != "oauth-code" {
+			t.Errorf("code = %q", form["code"])
+		}
+		if form["code_verifier"] == "" {
+			t.Error("exchange did not send the PKCE code_verifier")
+		}
+	})
+	withTestConfigs(t, srv.URL)
+
+	req := OAuthRequest{Brand: "MyPeugeot", Country: "DE", Email: "driver@example.com", Password: "secret", Exchange: true}
+	data, err := performOAuthWithExecutor(
+		context.Background(), req, "request-id", nil, nil, newOAuthMetrics(),
+		stubExecutors(func(attempt oauthAttempt, _ ProgressFunc, _ DebugFunc) (authCode, error) {
+			authURL, _ := url.Parse(attempt.authURL)
+			srv.nonce = authURL.Query().Get("nonce")
+			return authCode{value: "oauth-code", issuedAt: time.Now()}, nil
+		}),
+	)
+	if err != nil {
+		t.Fatalf("performOAuthWithExecutor() error = %v", err)
+	}
+	if data.Code != "oauth-code" || data.AccessToken != "at" {
+		t.Errorf("unexpected data: %+v", data)
+	}
+	if data.Claims == nil || data.Claims.Subject != "user-1" {
+		t.Errorf("id_token claims not verified/attached: %+v", data.Claims)
+	}
+}
+
+func TestPerformOAuthWithExecutorRejectsNonceMismatch(t *testing.T) {
+	srv := newTestTokenServer(t, func(map[string]string) {})
+	srv.nonce = "replayed-nonce"
+	withTestConfigs(t, srv.URL)
+
+	req := OAuthRequest{Brand: "MyPeugeot", Country: "DE", Email: "driver@example.com", Password: "secret", Exchange: true}
+	_, err := performOAuthWithExecutor(
+		context.Background(), req, "request-id", nil, nil, newOAuthMetrics(),
+		stubExecutors(func(oauthAttempt, ProgressFunc, DebugFunc) (authCode, error) {
+			return authCode{value: "oauth-code", issuedAt: time.Now()}, nil
+		}),
+	)
+	if err == nil || !strings.Contains(err.Error(), "nonce") {
+		t.Fatalf("performOAuthWithExecutor() error = %v, want nonce mismatch", err)
+	}
+}
+
+func TestPerformOAuthWithExecutorCountsFailedExchangeAsFailure(t *testing.T) {
+	srv := newTestTokenServer(t, func(map[string]string) {})
+	srv.nonce = "replayed-nonce"
+	withTestConfigs(t, srv.URL)
+	metrics := newOAuthMetrics()
+	if err := metrics.initialize(configsJSON); err != nil {
+		t.Fatalf("initialize() error = %v", err)
+	}
+
+	req := OAuthRequest{Brand: "MyPeugeot", Country: "DE", Email: "driver@example.com", Password: "secret", Exchange: true}
+	if _, err := performOAuthWithExecutor(context.Background(), req, "request-id", nil, nil, metrics, stubExecutors(succeedWith("oauth-code"))); err == nil {
+		t.Fatal("performOAuthWithExecutor() error = nil, want nonce mismatch")
+	}
+
+	body := scrapeMetrics(t, metrics.handler())
+	for _, want := range []string{
+		`stelloauth_oauth_failure_total{brand="MyPeugeot",country="DE"} 1`,
+		`stelloauth_oauth_success_total{brand="MyPeugeot",country="DE"} 0`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics body missing %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestHandleToken(t *testing.T) {
+	srv := newTestTokenServer(t, func(form map[string]string) {
+		if form["code"] != "pasted-code" {
+			t.Errorf("code = %q", form["code"])
+		}
+	})
+	withTestConfigs(t, srv.URL)
+
+	body := `{"brand":"MyPeugeot","country":"DE","code":"pasted-code"}`
+	req := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(body))
+	w := httptest.NewRecorder()
+
+	handleToken(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	var resp OAuthResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if resp.Status != "success" || resp.Data == nil || resp.Data.AccessToken != "at" {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	if resp.Data.Claims == nil || resp.Data.Claims.Email != "driver@example.com" {
+		t.Errorf("claims = %+v, want decoded id_token claims", resp.Data.Claims)
+	}
+}
+
+func TestHandleToken_MissingFields(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(`{"brand":"MyPeugeot"}`))
+	w := httptest.NewRecorder()
+
+	handleToken(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", w.Code)
+	}
+}
+
+func TestRefreshTokensKeepsRefreshTokenWhenNotRotated(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if r.PostForm.Get("grant_type") != "refresh_token" || r.PostForm.Get("refresh_token") != "old-rt" {
+			t.Errorf("unexpected form: %v", r.PostForm)
+		}
+		_, _ = w.Write([]byte(`{"access_token":"new-at","expires_in":3600}`))
+	}))
+	defer srv.Close()
+
+	data, err := refreshTokens(context.Background(), srv.Client(), BrandConfig{OAuthURL: srv.URL}, CountryConfig{}, "old-rt")
+	if err != nil {
+		t.Fatalf("refreshTokens() error = %v", err)
+	}
+	if data.AccessToken != "new-at" || data.RefreshToken != "old-rt" {
+		t.Errorf("unexpected tokens: %+v", data)
+	}
+}
+
+func TestHandleTokenRefresh(t *testing.T) {
+	srv := newTestTokenServer(t, func(form map[string]string) {
+		if form["grant_type"] != "refresh_token" || form["refresh_token"] != "stored-rt" {
+			t.Errorf("unexpected form: %v", form)
+		}
+	})
+	withTestConfigs(t, srv.URL)
+
+	body := `{"brand":"MyPeugeot","country":"DE","refresh_token":"stored-rt"}`
+	req := httptest.NewRequest(http.MethodPost, "/token/refresh", strings.NewReader(body))
+	w := httptest.NewRecorder()
+
+	newApplicationMux().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	var resp OAuthResponse
+	_ = json.NewDecoder(w.Body).Decode(&resp)
+	if resp.Data == nil || resp.Data.AccessToken != "at" || resp.Data.RefreshToken != "rt" {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+}
+
+func TestTokenEndpointsKeepTokensWhenJWKSIsDown(t *testing.T) {
+	srv := newTestTokenServer(t, func(map[string]string) {})
+	srv.jwksDown = true
+	withTestConfigs(t, srv.URL)
+
+	for path, body := range map[string]string{
+		"/token":         `{"brand":"MyPeugeot","country":"DE","code":"pasted-code"}`,
+		"/token/refresh": `{"brand":"MyPeugeot","country":"DE","refresh_token":"stored-rt"}`,
+	} {
+		w := httptest.NewRecorder()
+		newApplicationMux().ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+
+		var resp OAuthResponse
+		_ = json.NewDecoder(w.Body).Decode(&resp)
+		if w.Code != http.StatusOK || resp.Data == nil || resp.Data.RefreshToken != "rt" {
+			t.Fatalf("%s: status %d, response %+v, want the issued tokens", path, w.Code, resp)
+		}
+		if !resp.Data.IDTokenUnverified || resp.Data.Claims != nil {
+			t.Errorf("%s: unverified = %v, claims = %+v", path, resp.Data.IDTokenUnverified, resp.Data.Claims)
+		}
+	}
+}
+
+func TestHandleTokenRefresh_UnknownBrand(t *testing.T) {
+	body := `{"brand":"Nope","country":"DE","refresh_token":"rt"}`
+	req := httptest.NewRequest(http.MethodPost, "/token/refresh", strings.NewReader(body))
+	w := httptest.NewRecorder()
+
+	handleTokenRefresh(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", w.Code)
+	}
+}
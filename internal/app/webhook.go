@@ -0,0 +1,167 @@
+package app
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// webhookSignatureHeader carries "sha256=<hex HMAC-SHA256 of the body>", keyed
+// with WEBHOOK_SECRET.
+const webhookSignatureHeader = "X-Stelloauth-Signature"
+
+const (
+	webhookOutcomeSuccess = "success"
+	webhookOutcomeFailure = "failure"
+)
+
+// webhookEvent is the JSON body POSTed to every webhook URL once an OAuth
+// request has finished.
+type webhookEvent struct {
+	RequestID string    `json:"request_id"`
+	Brand     string    `json:"brand"`
+	Country   string    `json:"country"`
+	Outcome   string    `json:"outcome"`
+	ErrorCode errorCode `json:"error_code,omitempty"`
+	Code      string    `json:"code,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// webhookNotifier delivers webhook events in the background, retrying each URL
+// with exponential backoff.
+type webhookNotifier struct {
+	client      *http.Client
+	urls        []string
+	secret      []byte
+	includeCode bool
+	maxAttempts int
+	backoff     time.Duration // delay before the 2nd attempt, doubled after each
+}
+
+// webhooks is nil when WEBHOOK_URLS is unset; notify is a no-op then.
+var webhooks *webhookNotifier
+
+func initWebhooks() {
+	var urls []string
+	for u := range strings.SplitSeq(os.Getenv("WEBHOOK_URLS"), ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	if len(urls) == 0 {
+		webhooks = nil
+		return
+	}
+	webhooks = &webhookNotifier{
+		client:      &http.Client{Timeout: 10 * time.Second},
+		urls:        urls,
+		secret:      []byte(os.Getenv("WEBHOOK_SECRET")),
+		includeCode: os.Getenv("WEBHOOK_INCLUDE_CODE") == "true",
+		maxAttempts: max(getIntEnv("WEBHOOK_MAX_ATTEMPTS", 5), 1),
+		backoff:     getDurationEnv("WEBHOOK_BACKOFF", time.Second),
+	}
+	if len(webhooks.secret) == 0 {
+		log.Printf("WEBHOOK_SECRET is unset: webhook deliveries will not be signed")
+	}
+	log.Printf("Webhooks enabled for %d URL(s)", len(urls))
+}
+
+// newWebhookEvent describes the outcome of an OAuth request. The code is only
+// filled in here; notify strips it unless WEBHOOK_INCLUDE_CODE is set.
+func newWebhookEvent(req OAuthRequest, requestID string, data *OAuthData, err error) webhookEvent {
+	ev := webhookEvent{
+		RequestID: requestID,
+		Brand:     req.Brand,
+		Country:   req.Country,
+		Outcome:   webhookOutcomeSuccess,
+		Timestamp: time.Now().UTC(),
+	}
+	if err != nil {
+		ev.Outcome = webhookOutcomeFailure
+		ev.ErrorCode = errorCodeOf(err)
+	} else if data != nil {
+		ev.Code = data.Code
+	}
+	return ev
+}
+
+// notify sends ev to every configured URL without blocking the caller.
+func (n *webhookNotifier) notify(ev webhookEvent) {
+	if n == nil {
+		return
+	}
+	if !n.includeCode {
+		ev.Code = ""
+	}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("[%s] Webhook event not sent: %v", ev.RequestID, err)
+		return
+	}
+	for _, u := range n.urls {
+		go func() {
+			if err := n.deliver(u, body); err != nil {
+				log.Printf("[%s] Webhook delivery to %s failed: %v", ev.RequestID, u, err)
+			}
+		}()
+	}
+}
+
+// deliver POSTs body to url until it is accepted, the receiver rejects it
+// outright (a 4xx other than 408/429) or maxAttempts is reached.
+func (n *webhookNotifier) deliver(url string, body []byte) error {
+	delay := n.backoff
+	var err error
+	for attempt := 1; attempt <= n.maxAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		var retry bool
+		if retry, err = n.post(url, body); err == nil || !retry {
+			return err
+		}
+	}
+	return fmt.Errorf("giving up after %d attempts: %w", n.maxAttempts, err)
+}
+
+// post makes a single delivery attempt and reports whether a failure is worth
+// retrying.
+func (n *webhookNotifier) post(url string, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(n.secret) > 0 {
+		req.Header.Set(webhookSignatureHeader, signWebhook(n.secret, body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode >= 500 ||
+		resp.StatusCode == http.StatusRequestTimeout ||
+		resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("unexpected status %d", resp.StatusCode)
+}
+
+// signWebhook returns the webhookSignatureHeader value for body.
+func signWebhook(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,130 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookDeliverySignsAndRetries(t *testing.T) {
+	secret := []byte("shh")
+	var attempts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if got, want := r.Header.Get(webhookSignatureHeader), signWebhook(secret, body); got != want {
+			t.Errorf("signature = %q, want %q", got, want)
+		}
+		if attempts.Add(1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+
+	n := &webhookNotifier{client: srv.Client(), secret: secret, maxAttempts: 5, backoff: time.Millisecond}
+	if err := n.deliver(srv.URL, []byte(`{"outcome":"success"}`)); err != nil {
+		t.Fatalf("deliver() error = %v", err)
+	}
+	if got := attempts.Load(); got != 3 {
+		t.Errorf("attempts = %d, want 3", got)
+	}
+}
+
+func TestWebhookDeliveryGivesUp(t *testing.T) {
+	cases := []struct {
+		name   string
+		status int
+		want   int32
+	}{
+		{name: "client error is not retried", status: http.StatusBadRequest, want: 1},
+		{name: "server error exhausts attempts", status: http.StatusInternalServerError, want: 3},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				attempts.Add(1)
+				w.WriteHeader(tc.status)
+			}))
+			defer srv.Close()
+
+			n := &webhookNotifier{client: srv.Client(), maxAttempts: 3, backoff: time.Millisecond}
+			if err := n.deliver(srv.URL, []byte(`{}`)); err == nil {
+				t.Fatal("deliver() error = nil, want failure")
+			}
+			if got := attempts.Load(); got != tc.want {
+				t.Errorf("attempts = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPerformOAuthWithExecutorNotifiesWebhooks(t *testing.T) {
+	events := make(chan webhookEvent, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		var ev webhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+		events <- ev
+	}))
+	defer srv.Close()
+	setGlobal(t, &webhooks, &webhookNotifier{client: srv.Client(), urls: []string{srv.URL}, maxAttempts: 1})
+
+	cases := []struct {
+		name  string
+		brand string
+		want  errorCode
+	}{
+		{"login failure", "MyPeugeot", codeAuthFailed},
+		{"unknown brand", "Nope", codeUnknownBrand},
+	}
+	for _, tc := range cases {
+		req := OAuthRequest{Brand: tc.brand, Country: "DE", Email: "driver@example.com", Password: "secret"}
+		_, err := performOAuthWithExecutor(
+			context.Background(), req, "request-id", nil, nil, newOAuthMetrics(),
+			stubExecutors(func(oauthAttempt, ProgressFunc, DebugFunc) (authCode, error) {
+				return authCode{}, fmt.Errorf("%w: wrong password", errAuthFailed)
+			}),
+		)
+		if err == nil {
+			t.Fatalf("%s: performOAuthWithExecutor() error = nil, want a failure", tc.name)
+		}
+
+		select {
+		case ev := <-events:
+			if ev.RequestID != "request-id" || ev.Outcome != webhookOutcomeFailure || ev.ErrorCode != tc.want {
+				t.Errorf("%s: unexpected event: %+v", tc.name, ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: webhook not delivered", tc.name)
+		}
+	}
+}
+
+func TestWebhookNotifyStripsCode(t *testing.T) {
+	events := make(chan webhookEvent, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		var ev webhookEvent
+		_ = json.NewDecoder(r.Body).Decode(&ev)
+		events <- ev
+	}))
+	defer srv.Close()
+
+	n := &webhookNotifier{client: srv.Client(), urls: []string{srv.URL}, maxAttempts: 1}
+	n.notify(newWebhookEvent(OAuthRequest{Brand: "MyPeugeot", Country: "DE"}, "id", &OAuthData{Code: "c"}, nil))
+
+	select {
+	case ev := <-events:
+		if ev.Outcome != webhookOutcomeSuccess || ev.Code != "" {
+			t.Errorf("unexpected event: %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not delivered")
+	}
+}